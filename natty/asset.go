@@ -0,0 +1,77 @@
+package natty
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/getlantern/byteexec"
+)
+
+// AssetFunc loads the named asset, like the Asset function generated by
+// go-bindata.
+type AssetFunc func(name string) ([]byte, error)
+
+var (
+	assetExecs      = make(map[string]*byteexec.Exec)
+	assetExecsMutex sync.Mutex
+)
+
+// assetExec loads the natty binary using assetFunc and returns a
+// byteexec.Exec for it, extracted to dir or, if dir is empty, byteexec's
+// default location. Execs are cached by the contents of the binary and dir,
+// so that each distinct binary is only written to disk once per directory and
+// different binaries don't clobber each other.
+func assetExec(assetFunc AssetFunc, dir string) (*byteexec.Exec, error) {
+	data, err := assetFunc("natty")
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to read natty bytes: %v", ErrBinaryNotFound, err)
+	}
+
+	sum := sha256.Sum256(data)
+	filename := "natty-" + hex.EncodeToString(sum[:8])
+	if dir != "" {
+		// byteexec uses absolute filenames as they are
+		filename = filepath.Join(dir, filename)
+	}
+
+	assetExecsMutex.Lock()
+	defer assetExecsMutex.Unlock()
+	be := assetExecs[filename]
+	if be == nil {
+		if dir != "" {
+			err = checkExtractDir(dir)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to extract natty to %s: %s", dir, err)
+			}
+		}
+		be, err = byteexec.New(data, filename)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to construct byteexec for natty: %s", err)
+		}
+		assetExecs[filename] = be
+	}
+	return be, nil
+}
+
+// checkExtractDir makes sure that dir is a directory to which we can write
+// natty and from which we can run it.
+func checkExtractDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	f, err := os.CreateTemp(dir, ".natty-check-")
+	if err != nil {
+		return fmt.Errorf("directory not writable: %s", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return checkExecutable(dir)
+}
@@ -0,0 +1,96 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	defaultMaxConcurrency = 16
+)
+
+// BatchOption configures TraverseAll.
+type BatchOption func(b *batch)
+
+type batch struct {
+	maxConcurrency int
+}
+
+// WithMaxConcurrency limits how many traversals TraverseAll runs at once, and
+// so how many natty processes it spawns at once. The default is 16. Values
+// less than 1 are ignored.
+func WithMaxConcurrency(n int) BatchOption {
+	return func(b *batch) {
+		if n > 0 {
+			b.maxConcurrency = n
+		}
+	}
+}
+
+// TraverseAll traverses to each of peers concurrently, for example to connect
+// a node to the rest of a mesh, and returns the FiveTuples obtained and the
+// errors encountered, keyed by peer ID. Every peer ends up in exactly one of
+// the two maps. factory is called with each peer ID to start that peer's
+// Traversal, and is responsible for wiring up signaling with the peer. Each
+// Traversal is closed once it has finished. If factory returns a Traversal
+// that hasn't been started, that peer fails right away with ErrNotStarted.
+// Peers still waiting for a slot or traversing when ctx is done fail with
+// ctx.Err(). peers should not contain duplicates.
+func TraverseAll(ctx context.Context, factory func(peerID string) *Traversal, peers []string, opts ...BatchOption) (map[string]*FiveTuple, map[string]error) {
+	b := &batch{maxConcurrency: defaultMaxConcurrency}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	fiveTuples := make(map[string]*FiveTuple)
+	errs := make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, b.maxConcurrency)
+	for _, peerID := range peers {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			mutex.Lock()
+			errs[peerID] = ctx.Err()
+			mutex.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(peerID string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ft, err := traverseOne(ctx, factory, peerID)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Tracef("Traversal to %s failed: %s", peerID, err)
+				errs[peerID] = err
+			} else {
+				fiveTuples[peerID] = ft
+			}
+		}(peerID)
+	}
+	wg.Wait()
+	return fiveTuples, errs
+}
+
+func traverseOne(ctx context.Context, factory func(peerID string) *Traversal, peerID string) (*FiveTuple, error) {
+	t := factory(peerID)
+	if t == nil {
+		return nil, fmt.Errorf("No Traversal for peer %s", peerID)
+	}
+	defer t.Close()
+
+	done := t.Done()
+	if done == nil {
+		return nil, ErrNotStarted
+	}
+	select {
+	case <-done:
+		return t.FiveTuple()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,85 @@
+package natty
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraverseAll(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		fmt.Fprintln(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`)
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	factory := func(peerID string) *Traversal {
+		switch peerID {
+		case "missing":
+			return nil
+		case "failing":
+			return OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 1")))
+		}
+		offer := OfferWithOptions(withCommandRunner(fakeRunner(script)))
+		offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`)
+		return offer
+	}
+
+	peers := []string{"a", "b", "c", "d", "e", "missing", "failing"}
+	fiveTuples, errs := TraverseAll(context.Background(), factory, peers, WithMaxConcurrency(2))
+	assert.Len(t, fiveTuples, 5)
+	for _, peerID := range peers[:5] {
+		if assert.NotNil(t, fiveTuples[peerID], "Missing FiveTuple for %s", peerID) {
+			assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", fiveTuples[peerID].String())
+		}
+	}
+	assert.Len(t, errs, 2)
+	assert.Error(t, errs["missing"])
+	assert.Error(t, errs["failing"])
+	mutex.Lock()
+	assert.Equal(t, 2, maxRunning, "Traversals should be limited by WithMaxConcurrency")
+	mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	hanging := func(peerID string) *Traversal {
+		return OfferWithOptions(WithBinaryPath(fakeNatty(t, "exec sleep 30")))
+	}
+	fiveTuples, errs = TraverseAll(ctx, hanging, []string{"a", "b", "c"}, WithMaxConcurrency(1))
+	assert.Empty(t, fiveTuples)
+	assert.Len(t, errs, 3)
+	for peerID, err := range errs {
+		assert.Equal(t, context.DeadlineExceeded, err, "Wrong error for %s", peerID)
+	}
+}
+
+func TestTraverseAllUnstarted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	unstarted := func(peerID string) *Traversal {
+		return New(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}))
+	}
+	start := time.Now()
+	fiveTuples, errs := TraverseAll(ctx, unstarted, []string{"a"})
+	assert.Empty(t, fiveTuples)
+	assert.Equal(t, ErrNotStarted, errs["a"])
+	assert.True(t, time.Since(start) < time.Second, "Unstarted Traversals should fail right away")
+}
@@ -0,0 +1,215 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// candidatePattern finds the SDP candidate attribute (RFC 5245 section 15.1)
+// in a message from natty, whatever JSON it's wrapped in.
+var candidatePattern = regexp.MustCompile(`candidate:\S+ \d+ \S+ \d+ \S+ \d+ typ \w+`)
+
+// Candidate describes an ICE candidate gathered by natty.
+type Candidate struct {
+	Foundation string   // identifies candidates that share a base
+	Component  int      // the component ID, 1 for RTP
+	Protocol   Protocol // the transport protocol, UDP or TCP
+	Priority   uint32   // the candidate's priority, higher is better
+	Address    string   // the candidate's IP address
+	Port       int      // the candidate's port
+	Type       string   // the candidate type: host, srflx, prflx or relay
+}
+
+// HostPort returns the address and port of this Candidate joined together.
+func (c Candidate) HostPort() string {
+	return net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
+}
+
+// ParseCandidate parses an SDP candidate attribute like
+// "candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host". Any attributes
+// following the type are ignored.
+func ParseCandidate(attr string) (*Candidate, error) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimPrefix(attr, "a="), "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return nil, fmt.Errorf("Unable to parse candidate %q: too few fields", attr)
+	}
+	component, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse component of candidate %q: %s", attr, err)
+	}
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse priority of candidate %q: %s", attr, err)
+	}
+	port, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse port of candidate %q: %s", attr, err)
+	}
+	return &Candidate{
+		Foundation: fields[0],
+		Component:  component,
+		Protocol:   Protocol(strings.ToLower(fields[2])),
+		Priority:   uint32(priority),
+		Address:    fields[4],
+		Port:       port,
+		Type:       fields[7],
+	}, nil
+}
+
+// LocalCandidates returns all of the local ICE candidates that natty has
+// gathered so far, in the order in which they were gathered, whether they were
+// sent on their own or as part of a session description. It's safe to call
+// at any time, including after the Traversal has finished.
+func (t *Traversal) LocalCandidates() []Candidate {
+	t.candidatesMutex.Lock()
+	defer t.candidatesMutex.Unlock()
+	return append([]Candidate(nil), t.candidates...)
+}
+
+// GatheredInterfaces returns the IP addresses of the local interfaces that
+// natty considered, taken from the host candidates it has gathered so far, in
+// the order in which they were first gathered and without duplicates. On a
+// multi-homed host, this helps explain why a particular interface wasn't used.
+// If no host candidates have been gathered, it returns an empty slice.
+func (t *Traversal) GatheredInterfaces() []string {
+	t.candidatesMutex.Lock()
+	defer t.candidatesMutex.Unlock()
+	interfaces := []string{}
+	seen := make(map[string]bool)
+	for _, candidate := range t.candidates {
+		if candidate.Type == "host" && !seen[candidate.Address] {
+			seen[candidate.Address] = true
+			interfaces = append(interfaces, candidate.Address)
+		}
+	}
+	return interfaces
+}
+
+// CandidatePair is a pair of local and remote ICE candidates. See
+// SelectedPair.
+type CandidatePair struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+// Relayed reports whether either candidate in this pair is a relay candidate,
+// meaning that traffic goes through a TURN server.
+func (p CandidatePair) Relayed() bool {
+	return p.Local.Type == "relay" || p.Remote.Type == "relay"
+}
+
+// relayed reports whether ft goes through a TURN relay, see Stats.Relayed.
+func (t *Traversal) relayed(ft *FiveTuple) bool {
+	if t.forceRelay {
+		return true
+	}
+	canonical := ft.Canonical()
+	t.candidatesMutex.Lock()
+	defer t.candidatesMutex.Unlock()
+	local, _ := matchCandidate(t.candidates, canonical.Local)
+	remote, _ := matchCandidate(t.remoteCandidates, canonical.Remote)
+	return CandidatePair{local, remote}.Relayed()
+}
+
+// SelectedPair returns the candidate pair that natty selected, found by
+// matching the addresses of the resulting FiveTuple against the candidates
+// that natty gathered and the ones received from the peer. This shows the
+// quality of the path, for example whether it's relayed (a Type of "relay")
+// and with what priority. natty doesn't report the selected pair itself, so any
+// candidate that can't be matched, for example because a peer-reflexive
+// candidate was discovered during connectivity checks, is left zero, including
+// its Priority. If the traversal hasn't succeeded, ok is false.
+func (t *Traversal) SelectedPair() (pair CandidatePair, ok bool) {
+	select {
+	case <-t.finishedCh:
+	default:
+		return pair, false
+	}
+	if t.errOut != nil {
+		return pair, false
+	}
+
+	ft := t.fiveTupleOut.Canonical()
+	t.candidatesMutex.Lock()
+	defer t.candidatesMutex.Unlock()
+	pair.Local, _ = matchCandidate(t.candidates, ft.Local)
+	pair.Remote, _ = matchCandidate(t.remoteCandidates, ft.Remote)
+	return pair, true
+}
+
+// foundations are the foundations of a candidate pair, as natty reports them
+// alongside a 5-tuple.
+type foundations struct {
+	Local  string `json:"localFoundation"`
+	Remote string `json:"remoteFoundation"`
+}
+
+// SelectedFoundations returns the foundations of the local and remote
+// candidates in the pair that natty selected, so that for example a
+// coordinator can confirm that both peers converged on the same pair (one
+// peer's local foundation being the other's remote foundation). Versions of
+// natty that report them do so in the localFoundation and remoteFoundation
+// fields of the 5-tuple. Otherwise, they're taken from the candidates matched
+// by SelectedPair. If the traversal hasn't succeeded or the foundations aren't
+// known, ok is false.
+func (t *Traversal) SelectedFoundations() (local, remote string, ok bool) {
+	pair, ok := t.SelectedPair()
+	if !ok {
+		return "", "", false
+	}
+	t.candidatesMutex.Lock()
+	reported := t.foundations
+	t.candidatesMutex.Unlock()
+	if reported.Local != "" && reported.Remote != "" {
+		return reported.Local, reported.Remote, true
+	}
+	if pair.Local.Foundation != "" && pair.Remote.Foundation != "" {
+		return pair.Local.Foundation, pair.Remote.Foundation, true
+	}
+	return "", "", false
+}
+
+// matchCandidate finds the candidate in candidates with the given canonical
+// host:port.
+func matchCandidate(candidates []Candidate, hostport string) (Candidate, bool) {
+	for _, candidate := range candidates {
+		if canonicalHostPort(candidate.HostPort()) == hostport {
+			return candidate, true
+		}
+	}
+	return Candidate{}, false
+}
+
+// MappedAddress returns the public address (host:port) of the first
+// server-reflexive candidate that natty has gathered, which is how this host
+// appears to the outside world according to the STUN server. This is available
+// as soon as natty has gathered the candidate, even if traversal later fails.
+// If no server-reflexive candidate has been gathered, ok is false.
+func (t *Traversal) MappedAddress() (addr string, ok bool) {
+	t.candidatesMutex.Lock()
+	defer t.candidatesMutex.Unlock()
+	for _, candidate := range t.candidates {
+		if candidate.Type == "srflx" {
+			return candidate.HostPort(), true
+		}
+	}
+	return "", false
+}
+
+// findCandidates extracts the Candidates carried by msg, of which there may be
+// several if msg is a session description.
+func findCandidates(msg string) []Candidate {
+	var candidates []Candidate
+	for _, attr := range candidatePattern.FindAllString(msg, -1) {
+		candidate, err := ParseCandidate(attr)
+		if err != nil {
+			log.Tracef("Skipping unparseable candidate: %s", err)
+			continue
+		}
+		candidates = append(candidates, *candidate)
+	}
+	return candidates
+}
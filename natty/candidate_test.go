@@ -0,0 +1,229 @@
+package natty
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCandidate(t *testing.T) {
+	c, err := ParseCandidate("candidate:842163049 1 UDP 1677729535 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Candidate{
+			Foundation: "842163049",
+			Component:  1,
+			Protocol:   UDP,
+			Priority:   1677729535,
+			Address:    "203.0.113.5",
+			Port:       6000,
+			Type:       "srflx",
+		}, c)
+		assert.Equal(t, "203.0.113.5:6000", c.HostPort())
+	}
+
+	_, err = ParseCandidate("candidate:1 1 udp 1 10.0.0.1 5000")
+	assert.Error(t, err, "Candidate without type should fail to parse")
+	_, err = ParseCandidate("candidate:1 1 udp high 10.0.0.1 5000 typ host")
+	assert.Error(t, err, "Candidate with bad priority should fail to parse")
+}
+
+func TestCandidateCallback(t *testing.T) {
+	script := `echo '{"type":"offer","sdp":"v=0"}'
+echo '{"type":"candidate","candidate":{"sdpMid":"data","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host generation 0"}}'
+echo '{"type":"candidate","candidate":"candidate:garbled"}'
+echo '{"type":"candidate","candidate":"candidate:2 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'`
+	var candidates []Candidate
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithCandidateCallback(func(c Candidate) {
+			candidates = append(candidates, c)
+		}))
+	defer offer.Close()
+	var msgs int
+	for range offer.Messages() {
+		msgs++
+	}
+	assert.Equal(t, 4, msgs, "All messages should still go to the peer")
+	if assert.Len(t, candidates, 2) {
+		assert.Equal(t, "host", candidates[0].Type)
+		assert.Equal(t, "10.0.0.1:5000", candidates[0].HostPort())
+		assert.Equal(t, "srflx", candidates[1].Type)
+		assert.Equal(t, uint32(1686052607), candidates[1].Priority)
+	}
+}
+
+func TestMappedAddress(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+echo '{"type":"candidate","candidate":"candidate:2 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'
+exit 1`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Error(t, err)
+	addr, ok := offer.MappedAddress()
+	assert.True(t, ok, "Should have found srflx candidate even though traversal failed")
+	assert.Equal(t, "203.0.113.5:6000", addr)
+
+	hostOnly := OfferWithOptions(WithBinaryPath(fakeNatty(t, `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'`)))
+	defer hostOnly.Close()
+	hostOnly.FiveTuple()
+	_, ok = hostOnly.MappedAddress()
+	assert.False(t, ok, "Host candidates aren't mapped addresses")
+}
+
+func TestLocalCandidates(t *testing.T) {
+	script := `printf '%s\n' '{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host\r\na=candidate:2 1 tcp 1518280447 10.0.0.1 9 typ host tcptype active\r\n"}'
+echo '{"type":"candidate","candidate":"candidate:3 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	assert.Empty(t, (&Traversal{}).LocalCandidates())
+	offer.FiveTuple()
+
+	candidates := offer.LocalCandidates()
+	if assert.Len(t, candidates, 3) {
+		assert.Equal(t, "1", candidates[0].Foundation)
+		assert.Equal(t, TCP, candidates[1].Protocol)
+		assert.Equal(t, 9, candidates[1].Port)
+		assert.Equal(t, "srflx", candidates[2].Type)
+		candidates[0].Type = "modified"
+		assert.Equal(t, "host", offer.LocalCandidates()[0].Type, "LocalCandidates should return a copy")
+	}
+}
+
+func TestLocalCandidatesWithOfferCallback(t *testing.T) {
+	script := `printf '%s\n' '{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host\r\n"}'
+echo '{"type":"candidate","candidate":"candidate:2 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'`
+	var reported []Candidate
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithOfferCallback(func(sdp []byte) {}),
+		WithCandidateCallback(func(candidate Candidate) {
+			reported = append(reported, candidate)
+		}))
+	defer offer.Close()
+	for range offer.Messages() {
+	}
+	offer.FiveTuple()
+
+	candidates := offer.LocalCandidates()
+	if assert.Len(t, candidates, 2, "Candidates in a session description passed to the offer callback should be recorded") {
+		assert.Equal(t, "10.0.0.1", candidates[0].Address)
+		assert.Equal(t, "srflx", candidates[1].Type)
+	}
+	assert.Equal(t, candidates, reported)
+	assert.Equal(t, []string{"10.0.0.1"}, offer.GatheredInterfaces())
+}
+
+func TestGatheredInterfaces(t *testing.T) {
+	script := `printf '%s\n' '{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host\r\na=candidate:2 1 tcp 1518280447 10.0.0.1 9 typ host tcptype active\r\n"}'
+echo '{"type":"candidate","candidate":"candidate:3 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'
+echo '{"type":"candidate","candidate":"candidate:4 1 udp 2122194687 192.168.1.20 5001 typ host"}'`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	interfaces := (&Traversal{}).GatheredInterfaces()
+	assert.NotNil(t, interfaces)
+	assert.Empty(t, interfaces)
+	offer.FiveTuple()
+
+	assert.Equal(t, []string{"10.0.0.1", "192.168.1.20"}, offer.GatheredInterfaces())
+}
+
+func TestSelectedPair(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+echo '{"type":"candidate","candidate":"candidate:2 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'
+read candidate
+echo '{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"198.51.100.7:7000"}'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	_, ok := offer.SelectedPair()
+	assert.False(t, ok, "Unfinished traversal should have no selected pair")
+
+	assert.NoError(t, offer.MsgIn(`{"type":"candidate","candidate":"candidate:9 1 udp 16777215 198.51.100.7 7000 typ relay raddr 0.0.0.0 rport 0"}`))
+	for msg := range offer.Messages() {
+		if IsFiveTuple(msg) {
+			assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"198.51.100.7:7000","remote":"10.0.0.1:5000"}`))
+		}
+	}
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+
+	pair, ok := offer.SelectedPair()
+	if assert.True(t, ok) {
+		assert.Equal(t, "host", pair.Local.Type)
+		assert.Equal(t, uint32(2122260223), pair.Local.Priority)
+		assert.Equal(t, "relay", pair.Remote.Type)
+		assert.Equal(t, uint32(16777215), pair.Remote.Priority)
+		assert.True(t, pair.Relayed())
+	}
+	assert.True(t, offer.Stats().Relayed, "Relay candidate on either side should make the result relayed")
+}
+
+func TestSelectedFoundations(t *testing.T) {
+	traverse := func(fiveTuple string, remoteCandidate string) *Traversal {
+		script := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+read candidate
+echo '` + fiveTuple + `'
+exec sleep 30`
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+		assert.NoError(t, offer.MsgIn(remoteCandidate))
+		for msg := range offer.Messages() {
+			if IsFiveTuple(msg) {
+				assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"198.51.100.7:7000","remote":"10.0.0.1:5000"}`))
+			}
+		}
+		_, err := offer.FiveTuple()
+		assert.NoError(t, err)
+		return offer
+	}
+	relay := `{"type":"candidate","candidate":"candidate:9 1 udp 16777215 198.51.100.7 7000 typ relay raddr 0.0.0.0 rport 0"}`
+
+	_, _, ok := (&Traversal{}).SelectedFoundations()
+	assert.False(t, ok, "Unstarted traversal should have no foundations")
+
+	reported := traverse(`{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"198.51.100.7:7000","localFoundation":"a1","remoteFoundation":"b2"}`, relay)
+	defer reported.Close()
+	local, remote, ok := reported.SelectedFoundations()
+	assert.True(t, ok)
+	assert.Equal(t, "a1", local, "Reported foundations should take precedence")
+	assert.Equal(t, "b2", remote)
+
+	matched := traverse(`{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"198.51.100.7:7000"}`, relay)
+	defer matched.Close()
+	local, remote, ok = matched.SelectedFoundations()
+	assert.True(t, ok)
+	assert.Equal(t, "1", local, "Foundations should fall back to matched candidates")
+	assert.Equal(t, "9", remote)
+
+	unmatched := traverse(`{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"198.51.100.7:7000"}`, `{"type":"candidate","candidate":"candidate:9 1 udp 16777215 198.51.100.8 7000 typ relay raddr 0.0.0.0 rport 0"}`)
+	defer unmatched.Close()
+	_, _, ok = unmatched.SelectedFoundations()
+	assert.False(t, ok, "Foundations of unmatched candidates are unknown")
+}
+
+func TestEndOfCandidates(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+echo '{"type":"end-of-candidates"}'
+read line
+echo "got $line" >&2`
+	ended := make(chan struct{}, 2)
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithEndOfCandidatesCallback(func() {
+		ended <- struct{}{}
+	}))
+	defer offer.Close()
+	assert.True(t, strings.Contains(<-offer.Messages(), "typ host"))
+	assert.Equal(t, EndOfCandidates+"\n", <-offer.Messages(), "End of candidates should be passed to peer after candidates")
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("End of candidates callback wasn't called")
+	}
+
+	assert.NoError(t, offer.MsgIn(EndOfCandidates))
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err)
+	assert.Contains(t, offer.LastError(), "got "+EndOfCandidates, "Peer's end of candidates should be forwarded to natty")
+	assert.Len(t, ended, 0, "Callback should be called once")
+}
@@ -0,0 +1,110 @@
+package natty
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	binaryUsers      int // number of natty commands that run from an extracted binary
+	binaryUsersMutex sync.Mutex
+
+	cleanupOnSignalsOnce sync.Once // makes sure that the handler for WithCleanupOnExit is only installed once
+)
+
+// acquireBinary records that natty is about to be run from an extracted
+// binary, so that Cleanup doesn't remove it in the meantime.
+func acquireBinary() {
+	binaryUsersMutex.Lock()
+	binaryUsers++
+	binaryUsersMutex.Unlock()
+}
+
+// releaseBinary records that natty is no longer being run by whoever called
+// acquireBinary.
+func releaseBinary() {
+	binaryUsersMutex.Lock()
+	binaryUsers--
+	binaryUsersMutex.Unlock()
+}
+
+// Cleanup removes the natty binaries that this package extracted to disk,
+// for services that want to leave nothing behind when shutting down. It fails
+// while natty is running from an extracted binary, for a Traversal or for
+// something like BinaryVersion(). Traversals that don't use the extracted
+// binary, like those configured with WithBinaryPath or WithEcho, don't hold
+// up Cleanup. Binaries are extracted again if a Traversal is started after
+// Cleanup.
+func Cleanup() error {
+	binaryUsersMutex.Lock()
+	defer binaryUsersMutex.Unlock()
+	if binaryUsers > 0 {
+		return fmt.Errorf("Unable to clean up natty binaries while natty is running (%d in use)", binaryUsers)
+	}
+	return removeBinaries()
+}
+
+// cleanupOnSignals installs a handler that removes the extracted natty
+// binaries when the process is told to exit with SIGINT or SIGTERM. Once the
+// binaries are removed, the signal is raised again without the handler, so
+// that it has the effect that it would have had otherwise.
+func cleanupOnSignals() {
+	cleanupOnSignalsOnce.Do(func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-sigCh
+			signal.Stop(sigCh)
+			log.Tracef("Got %v, cleaning up natty binaries", sig)
+			// The process is exiting, so don't wait for natty. Running
+			// processes are unaffected by their binary being removed anyway,
+			// except on Windows, where it fails.
+			binaryUsersMutex.Lock()
+			err := removeBinaries()
+			binaryUsersMutex.Unlock()
+			if err != nil {
+				log.Errorf("%v", err)
+			}
+			p, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = p.Signal(sig)
+			}
+			if err != nil {
+				// Windows can't raise signals
+				os.Exit(2)
+			}
+		}()
+	})
+}
+
+// removeBinaries removes all extracted natty binaries and forgets about them,
+// returning the first error encountered. binaryUsersMutex must be held.
+func removeBinaries() error {
+	var firstErr error
+	remove := func(filename string) {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("Unable to remove natty binary: %v", err)
+		}
+	}
+
+	nattybeMutex.Lock()
+	if nattybe != nil {
+		remove(nattybe.Filename)
+	}
+	nattybe = nil
+	nattybeErr = nil
+	nattybeMutex.Unlock()
+
+	assetExecsMutex.Lock()
+	for key, be := range assetExecs {
+		remove(be.Filename)
+		delete(assetExecs, key)
+	}
+	assetExecsMutex.Unlock()
+
+	return firstErr
+}
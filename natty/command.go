@@ -0,0 +1,135 @@
+package natty
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// command is a natty process. It's an interface so that tests can replace
+// natty with a scripted fake.
+type command interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
+	Start() error
+	Wait() error
+	// Pid returns the process ID, 0 if the command runs in-process without a
+	// process of its own, or -1 if the command hasn't been started.
+	Pid() int
+	// Terminate asks the process to exit.
+	Terminate() error
+	// Kill kills the process immediately.
+	Kill() error
+	// ExitCode returns the exit status of the exited process, or -1 if it
+	// hasn't exited or was killed by a signal.
+	ExitCode() int
+}
+
+// commandRunner creates the command for running natty with the given params.
+type commandRunner func(t *Traversal, params []string) (command, error)
+
+// execRunner is the commandRunner that runs the real natty binary.
+func execRunner(t *Traversal, params []string) (command, error) {
+	// Keep Cleanup from removing the extracted binary until natty is done
+	// with it
+	extracted := t.binaryPath == ""
+	if extracted {
+		acquireBinary()
+	}
+	cmd, err := t.nattyCommand(params...)
+	if err != nil {
+		if extracted {
+			releaseBinary()
+		}
+		return nil, err
+	}
+	if len(t.env) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range t.env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	return &execCommand{Cmd: cmd, limits: t.resourceLimits, extracted: extracted}, nil
+}
+
+// withCommandRunner makes the Traversal use runner to create natty commands.
+func withCommandRunner(runner commandRunner) Option {
+	return func(t *Traversal) {
+		t.runner = runner
+	}
+}
+
+// discardCommand releases what cmd holds on to when it won't be started after
+// all.
+func discardCommand(cmd command) {
+	if c, ok := cmd.(*execCommand); ok {
+		c.release()
+	}
+}
+
+// execCommand is a command backed by an exec.Cmd.
+type execCommand struct {
+	*exec.Cmd
+	limits      *ResourceLimits // applied right after starting, if any
+	extracted   bool            // whether natty runs from the extracted binary (see acquireBinary)
+	releaseOnce sync.Once
+}
+
+// Start starts natty and applies the command's resource limits to it right
+// away. If they can't be applied, natty is killed and Start fails.
+func (c *execCommand) Start() error {
+	err := c.Cmd.Start()
+	if err != nil {
+		c.release()
+		return err
+	}
+	if c.limits == nil {
+		return nil
+	}
+	err = applyResourceLimits(c.Process.Pid, *c.limits)
+	if err != nil {
+		c.Process.Kill()
+		// Reap natty, which also closes the pipes
+		c.Wait()
+		return err
+	}
+	return nil
+}
+
+func (c *execCommand) Wait() error {
+	err := c.Cmd.Wait()
+	c.release()
+	return err
+}
+
+// release records that natty is no longer running from the extracted binary,
+// if it was.
+func (c *execCommand) release() {
+	if c.extracted {
+		c.releaseOnce.Do(releaseBinary)
+	}
+}
+
+func (c *execCommand) Pid() int {
+	if c.Process == nil {
+		return -1
+	}
+	return c.Process.Pid
+}
+
+func (c *execCommand) Terminate() error {
+	return terminate(c.Process)
+}
+
+func (c *execCommand) Kill() error {
+	return c.Process.Kill()
+}
+
+func (c *execCommand) ExitCode() int {
+	if c.ProcessState == nil {
+		return -1
+	}
+	return c.ProcessState.ExitCode()
+}
@@ -0,0 +1,239 @@
+package natty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCommand is a command that runs script in place of natty.
+type fakeCommand struct {
+	script   func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int
+	stdinR   *io.PipeReader
+	stdinW   *io.PipeWriter
+	stdoutR  *io.PipeReader
+	stdoutW  *io.PipeWriter
+	stderrR  *io.PipeReader
+	stderrW  *io.PipeWriter
+	started  bool
+	doneCh   chan struct{}
+	exitCode int
+	killOnce sync.Once
+}
+
+func fakeRunner(script func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int) commandRunner {
+	return func(t *Traversal, params []string) (command, error) {
+		c := &fakeCommand{script: script, doneCh: make(chan struct{}), exitCode: -1}
+		c.stdinR, c.stdinW = io.Pipe()
+		c.stdoutR, c.stdoutW = io.Pipe()
+		c.stderrR, c.stderrW = io.Pipe()
+		return c, nil
+	}
+}
+
+func (c *fakeCommand) StdinPipe() (io.WriteCloser, error) { return c.stdinW, nil }
+func (c *fakeCommand) StdoutPipe() (io.ReadCloser, error) { return c.stdoutR, nil }
+func (c *fakeCommand) StderrPipe() (io.ReadCloser, error) { return c.stderrR, nil }
+func (c *fakeCommand) Terminate() error                   { return c.Kill() }
+func (c *fakeCommand) ExitCode() int                      { return c.exitCode }
+
+func (c *fakeCommand) Start() error {
+	c.started = true
+	go func() {
+		exitCode := c.script(bufio.NewReader(c.stdinR), c.stdoutW, c.stderrW)
+		c.stdoutW.Close()
+		c.stderrW.Close()
+		c.exitCode = exitCode
+		close(c.doneCh)
+	}()
+	return nil
+}
+
+func (c *fakeCommand) Wait() error {
+	<-c.doneCh
+	if c.exitCode != 0 {
+		return fmt.Errorf("exit status %d", c.exitCode)
+	}
+	return nil
+}
+
+func (c *fakeCommand) Pid() int {
+	if !c.started {
+		return -1
+	}
+	return 12345
+}
+
+func (c *fakeCommand) Kill() error {
+	c.killOnce.Do(func() {
+		killed := errors.New("killed")
+		c.stdinR.CloseWithError(killed)
+		c.stdoutW.CloseWithError(killed)
+		c.stderrW.CloseWithError(killed)
+	})
+	return nil
+}
+
+func TestCommandRunner(t *testing.T) {
+	var received string
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintln(stderr, "gathering candidates")
+		fmt.Fprintln(stdout, `{"type":"candidate","candidate":"a"}`)
+		received, _ = stdin.ReadString('\n')
+		fmt.Fprintln(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`)
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)))
+	defer offer.Close()
+
+	assert.Equal(t, "{\"type\":\"candidate\",\"candidate\":\"a\"}\n", <-offer.Messages())
+	assert.Equal(t, 12345, offer.PID())
+	assert.NoError(t, offer.MsgIn("hello"))
+	assert.True(t, IsFiveTuple(<-offer.Messages()))
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+
+	ft, err := offer.FiveTuple()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+	}
+	assert.Equal(t, "hello\n", received, "MsgIn should forward messages to natty's stdin")
+	assert.Equal(t, "gathering candidates\n", offer.LastError())
+	assert.Equal(t, -1, offer.PID())
+}
+
+func TestCommandRunnerFailure(t *testing.T) {
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintln(stderr, "no route")
+		return 2
+	}
+	answer := AnswerWithOptions(withCommandRunner(fakeRunner(script)))
+	defer answer.Close()
+	_, err := answer.FiveTuple()
+	var terr *TraversalError
+	if assert.True(t, errors.As(err, &terr), "Failing natty should give TraversalError, not %v", err) {
+		assert.Equal(t, 2, terr.ExitCode)
+		assert.Equal(t, "no route\n", terr.Stderr)
+	}
+}
+
+func TestClosedStdin(t *testing.T) {
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintln(stdout, `{"type":"candidate","candidate":"a"}`)
+		// Keep running without stdin until killed
+		for {
+			_, err := fmt.Fprint(stderr, ".")
+			if err != nil {
+				return -1
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	runner := func(t *Traversal, params []string) (command, error) {
+		c, err := fakeRunner(script)(t, params)
+		if err == nil {
+			c.(*fakeCommand).stdinR.Close()
+		}
+		return c, err
+	}
+	offer := OfferWithOptions(withCommandRunner(runner))
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn("hello"))
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrClosed, err, "Writing to closed stdin should give ErrClosed")
+}
+
+// failingStartCommand is a fakeCommand that fails to start with err.
+type failingStartCommand struct {
+	*fakeCommand
+	err error
+}
+
+func (c *failingStartCommand) Start() error {
+	// Like exec.Cmd, close the pipes on failure
+	c.Kill()
+	return c.err
+}
+
+// failingStderrCommand is a fakeCommand whose stderr pipe can't be opened.
+type failingStderrCommand struct {
+	*fakeCommand
+}
+
+func (c *failingStderrCommand) StderrPipe() (io.ReadCloser, error) {
+	return nil, errors.New("too many open files")
+}
+
+func TestPartialInitFailure(t *testing.T) {
+	var c *fakeCommand
+	runner := func(t *Traversal, params []string) (command, error) {
+		fc, _ := fakeRunner(nil)(t, params)
+		c = fc.(*fakeCommand)
+		return &failingStderrCommand{c}, nil
+	}
+	offer := OfferWithOptions(withCommandRunner(runner))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too many open files")
+	}
+	assert.False(t, c.started, "natty shouldn't be started")
+	_, err = c.stdinR.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "stdin pipe should have been closed")
+	_, err = c.stdoutW.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err, "stdout pipe should have been closed")
+}
+
+func TestIncompatibleBinary(t *testing.T) {
+	runner := func(t *Traversal, params []string) (command, error) {
+		c, _ := fakeRunner(nil)(t, params)
+		return &failingStartCommand{c.(*fakeCommand), &os.PathError{Op: "fork/exec", Path: "natty", Err: errExecFormat}}, nil
+	}
+	offer := OfferWithOptions(withCommandRunner(runner))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.True(t, errors.Is(err, ErrIncompatibleBinary), "Exec format error should give ErrIncompatibleBinary, not %v", err) {
+		assert.Contains(t, err.Error(), runtime.GOOS+"/"+runtime.GOARCH)
+	}
+	assert.Equal(t, FailureIncompatible, failureReason(err))
+}
+
+func TestHelperRunner(t *testing.T) {
+	var runs [][]string
+	var mx sync.Mutex
+	runner := func(t *Traversal, params []string) (command, error) {
+		mx.Lock()
+		runs = append(runs, params)
+		mx.Unlock()
+		if len(params) == 1 && params[0] == "-help" {
+			return fakeRunner(func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+				fmt.Fprintln(stdout, "  --bind (Local interface to gather candidates on)")
+				return 1
+			})(t, params)
+		}
+		return fakeRunner(func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+			return 0
+		})(t, params)
+	}
+	offer := OfferWithOptions(withCommandRunner(runner), WithLocalInterface("10.0.0.1"))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err, "natty should have been run after checking its flags")
+
+	mx.Lock()
+	defer mx.Unlock()
+	if assert.Len(t, runs, 2, "Helper runs should go through the commandRunner") {
+		assert.Equal(t, []string{"-help"}, runs[0])
+		assert.Contains(t, runs[1], "-bind")
+	}
+}
@@ -0,0 +1,89 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Connection returns a connection dialed with the FiveTuple obtained by this
+// Traversal (see FiveTuple.Dial), which is a *net.UDPConn or *net.TCPConn
+// depending on the protocol. The connection is dialed on the first call and
+// the same one is returned by later calls. It's owned by the Traversal, so
+// Close() closes it too.
+//
+// Connection doesn't wait for the traversal: if it hasn't finished yet,
+// Connection returns ErrNotFinished, and if it failed, Connection returns an
+// error wrapping the reason why.
+func (t *Traversal) Connection() (net.Conn, error) {
+	if t.finishedCh == nil {
+		return nil, ErrNotStarted
+	}
+	select {
+	case <-t.finishedCh:
+	default:
+		return nil, ErrNotFinished
+	}
+	if t.errOut != nil {
+		return nil, fmt.Errorf("Unable to get connection for failed traversal: %w", t.errOut)
+	}
+
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	if t.connClosed {
+		return nil, ErrClosed
+	}
+	if t.conn == nil {
+		conn, err := t.fiveTupleOut.Dial()
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	return t.conn, nil
+}
+
+// keepAlive keeps the NAT mapping for our Connection() open until the
+// Traversal is closed, as configured with WithKeepalive.
+func (t *Traversal) keepAlive() {
+	conn, err := t.Connection()
+	if err == ErrClosed {
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to keep connection alive: %s", err)
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(t.keepaliveInterval)
+		return
+	}
+
+	ticker := time.NewTicker(t.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := conn.Write(nil)
+			if err != nil {
+				log.Tracef("Unable to send keepalive, stopping: %s", err)
+				return
+			}
+		case <-t.closedCh:
+			return
+		}
+	}
+}
+
+// closeConnection closes the connection returned by Connection(), if any, and
+// makes sure that no new one is dialed.
+func (t *Traversal) closeConnection() {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	t.connClosed = true
+	if t.conn != nil {
+		log.Trace("Closing connection")
+		t.conn.Close()
+	}
+}
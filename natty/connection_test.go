@@ -0,0 +1,111 @@
+package natty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnection(t *testing.T) {
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer remote.Close()
+
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintf(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:0","remote":"%s"}`+"\n", remote.LocalAddr())
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)))
+	defer offer.Close()
+	_, err = (&Traversal{}).Connection()
+	assert.Equal(t, ErrNotStarted, err)
+	<-offer.Messages()
+	_, err = offer.Connection()
+	assert.Equal(t, ErrNotFinished, err)
+
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err = offer.FiveTuple()
+	assert.NoError(t, err)
+	conn, err := offer.Connection()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok := conn.(*net.UDPConn)
+	assert.True(t, ok, "UDP Connection should be a UDPConn")
+	again, err := offer.Connection()
+	assert.NoError(t, err)
+	assert.True(t, conn == again, "Connection should return the same connection each time")
+
+	_, err = conn.Write([]byte(MessageText))
+	assert.NoError(t, err)
+
+	offer.Close()
+	_, err = conn.Write([]byte(MessageText))
+	assert.Error(t, err, "Closing the Traversal should close its connection")
+	_, err = offer.Connection()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestConnectionFailed(t *testing.T) {
+	answer := AnswerWithOptions(withCommandRunner(fakeRunner(func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		return 1
+	})))
+	defer answer.Close()
+	answer.FiveTuple()
+	_, err := answer.Connection()
+	var terr *TraversalError
+	assert.True(t, errors.As(err, &terr), "Connection for failed traversal should give its error, not %v", err)
+}
+
+func TestKeepalive(t *testing.T) {
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer remote.Close()
+
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintf(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:0","remote":"%s"}`+"\n", remote.LocalAddr())
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)), WithKeepalive(20*time.Millisecond))
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err = offer.FiveTuple()
+	assert.NoError(t, err)
+
+	b := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := remote.ReadFrom(b)
+		if assert.NoError(t, err, "Should have received keepalive") {
+			assert.Equal(t, 0, n, "Keepalives should be empty")
+		}
+	}
+
+	offer.Close()
+	// Drain anything sent before closing
+	time.Sleep(50 * time.Millisecond)
+	for {
+		remote.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := remote.ReadFrom(b); err != nil {
+			break
+		}
+	}
+	remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = remote.ReadFrom(b)
+	assert.Error(t, err, "Keepalives should stop once closed")
+}
@@ -0,0 +1,159 @@
+package natty
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errEchoKilled = errors.New("echo natty killed")
+
+// echoUsage is what the simulated natty prints in response to -help.
+const echoUsage = `Usage of natty (echo simulation):
+  --offer (Generates an offer)
+  --debug (Enables debug output)
+  --stuns (Comma separated STUN server URIs)
+  --turn (TURN server URI)
+  --turnuser (TURN username)
+  --turnpass (TURN password)
+  --bind (Local interface to gather candidates on)
+  --relay (Only uses relayed candidates)
+  --restart (Accepts restart messages on stdin)
+`
+
+// WithEcho makes the Traversal simulate natty instead of running it, for
+// hermetic end-to-end tests of signaling plumbing that shouldn't depend on a
+// working network. The simulated natty immediately emits ft as its 5-tuple and
+// then sends every message that it receives from the peer straight back, so a
+// pair of echo Traversals wired together through the signaling channel both
+// finish with their respective ft. The simulation always uses FramingNewline
+// and has no process of its own, so PID() always reports -1. It claims to
+// support every flag that Traversals pass to natty, like -bind and -relay,
+// without acting on them, but like the bundled natty it has no version to
+// report to BinaryVersion().
+func WithEcho(ft FiveTuple) Option {
+	return func(t *Traversal) {
+		t.runner = echoRunner(ft)
+	}
+}
+
+func echoRunner(ft FiveTuple) commandRunner {
+	return func(t *Traversal, params []string) (command, error) {
+		c := &echoCommand{ft: ft, params: params, doneCh: make(chan struct{}), exitCode: -1}
+		c.stdinR, c.stdinW = io.Pipe()
+		c.stdoutR, c.stdoutW = io.Pipe()
+		c.stderrR, c.stderrW = io.Pipe()
+		return c, nil
+	}
+}
+
+// echoCommand is a command that simulates natty in-process.
+type echoCommand struct {
+	ft       FiveTuple
+	params   []string
+	stdinR   *io.PipeReader
+	stdinW   *io.PipeWriter
+	stdoutR  *io.PipeReader
+	stdoutW  *io.PipeWriter
+	stderrR  *io.PipeReader
+	stderrW  *io.PipeWriter
+	started  bool
+	doneCh   chan struct{}
+	exitCode int
+	exitErr  error
+	killed   bool
+	mx       sync.Mutex
+}
+
+func (c *echoCommand) StdinPipe() (io.WriteCloser, error) { return c.stdinW, nil }
+func (c *echoCommand) StdoutPipe() (io.ReadCloser, error) { return c.stdoutR, nil }
+func (c *echoCommand) StderrPipe() (io.ReadCloser, error) { return c.stderrR, nil }
+
+func (c *echoCommand) Start() error {
+	c.started = true
+	go c.run()
+	return nil
+}
+
+func (c *echoCommand) run() {
+	defer close(c.doneCh)
+	defer c.stderrW.Close()
+	defer c.stdoutW.Close()
+
+	// Answer helper runs (see runHelper) like a natty binary would
+	if len(c.params) == 1 && (c.params[0] == "-help" || c.params[0] == "-version") {
+		var err error
+		if c.params[0] == "-help" {
+			_, err = io.WriteString(c.stdoutW, echoUsage)
+		} else {
+			_, err = io.WriteString(c.stderrW, "Error: unrecognized flag -version\n")
+		}
+		c.exitCode, c.exitErr = 0, err
+		return
+	}
+
+	b, err := json.Marshal(&c.ft)
+	if err == nil {
+		_, err = c.stdoutW.Write(append(b, '\n'))
+	}
+	in := bufio.NewReader(c.stdinR)
+	for err == nil {
+		var msg string
+		msg, err = in.ReadString('\n')
+		if err == nil {
+			_, err = io.WriteString(c.stdoutW, msg)
+		}
+	}
+	c.mx.Lock()
+	killed := c.killed
+	c.mx.Unlock()
+	switch {
+	case killed:
+		c.exitErr = errEchoKilled
+	case err == io.EOF || err == io.ErrClosedPipe:
+		c.exitCode = 0
+	default:
+		c.exitErr = err
+	}
+}
+
+func (c *echoCommand) Wait() error {
+	<-c.doneCh
+	return c.exitErr
+}
+
+// Pid returns 0 once the simulation has started, since it has no process of
+// its own. Terminate and Kill stop the simulation itself.
+func (c *echoCommand) Pid() int {
+	if !c.started {
+		return -1
+	}
+	return 0
+}
+
+// Terminate makes the simulation exit cleanly, as natty does on SIGTERM.
+func (c *echoCommand) Terminate() error {
+	c.stdinR.Close()
+	return nil
+}
+
+func (c *echoCommand) Kill() error {
+	c.mx.Lock()
+	c.killed = true
+	c.mx.Unlock()
+	c.stdinR.CloseWithError(errEchoKilled)
+	c.stdoutW.CloseWithError(errEchoKilled)
+	c.stderrW.CloseWithError(errEchoKilled)
+	return nil
+}
+
+func (c *echoCommand) ExitCode() int {
+	select {
+	case <-c.doneCh:
+		return c.exitCode
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,58 @@
+package natty
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEcho(t *testing.T) {
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}))
+	defer offer.Close()
+
+	assert.Equal(t, "{\"type\":\"5-tuple\",\"proto\":\"udp\",\"local\":\"127.0.0.1:1\",\"remote\":\"127.0.0.1:2\"}\n", <-offer.Messages())
+	assert.Equal(t, -1, offer.PID(), "Simulated natty has no process")
+	assert.NoError(t, offer.MsgIn("hello"))
+	assert.Equal(t, "hello\n", <-offer.Messages(), "Received messages should be echoed")
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	ft, err := offer.FiveTuple()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+	}
+	assert.NoError(t, offer.Close(), "Echo natty should exit cleanly")
+	assert.Equal(t, 0, offer.ExitCode())
+}
+
+func TestEchoPair(t *testing.T) {
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}))
+	defer offer.Close()
+	answer := AnswerWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:2", "127.0.0.1:1"}))
+	defer answer.Close()
+
+	forward := func(from, to *Traversal) {
+		for msg := range from.Messages() {
+			to.MsgIn(msg)
+		}
+	}
+	go forward(offer, answer)
+	go forward(answer, offer)
+
+	ft, err := offer.FiveTuple()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+	}
+	ft, err = answer.FiveTuple()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:2->127.0.0.1:1", ft.String())
+	}
+}
+
+func TestEchoHelpers(t *testing.T) {
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithLocalInterface("127.0.0.1"))
+	defer offer.Close()
+	assert.True(t, IsFiveTuple(<-offer.Messages()), "Simulated natty should accept -bind")
+
+	_, err := offer.BinaryVersion()
+	assert.True(t, errors.Is(err, ErrVersionUnsupported), "Simulated natty has no version, got %v", err)
+}
@@ -0,0 +1,141 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrClosed is returned when using a Traversal that has already been
+	// closed.
+	ErrClosed = errors.New("Traversal closed")
+
+	// ErrNotStarted is returned when waiting for the result of a Traversal
+	// that was never started.
+	ErrNotStarted = errors.New("Traversal not started")
+
+	// ErrAlreadyStarted is returned by Start when the Traversal has already
+	// been started.
+	ErrAlreadyStarted = errors.New("Traversal already started")
+
+	// ErrNotFinished is returned when asking for something that's only
+	// available once a Traversal has finished.
+	ErrNotFinished = errors.New("Traversal not finished")
+
+	// ErrBinaryNotFound is returned when the natty binary could not be
+	// loaded.
+	ErrBinaryNotFound = errors.New("natty binary not found")
+
+	// ErrIncompatibleBinary is returned when the natty binary can't be run
+	// because it was built for a different operating system or CPU
+	// architecture.
+	ErrIncompatibleBinary = errors.New("Incompatible natty binary")
+
+	// ErrVersionUnsupported is returned by BinaryVersion when the natty binary
+	// doesn't support the -version flag, as is the case for the bundled one.
+	ErrVersionUnsupported = errors.New("natty binary does not report its version")
+
+	// ErrMalformedFiveTuple is returned when natty emits a 5-tuple that can't
+	// be parsed.
+	ErrMalformedFiveTuple = errors.New("Malformed five-tuple")
+
+	// ErrNoResult is returned when natty exits cleanly without producing a
+	// 5-tuple.
+	ErrNoResult = errors.New("natty exited without producing a five-tuple")
+
+	// ErrInvalidMessage is returned by MsgIn when given a message that can't
+	// be passed to natty, because it contains an embedded newline.
+	ErrInvalidMessage = errors.New("Message contains embedded newline")
+
+	// ErrRateLimited is returned by MsgIn when messages from the peer arrive
+	// faster than the rate configured with WithReceiveRateLimit. The message
+	// isn't passed to natty, but the Traversal remains usable.
+	ErrRateLimited = errors.New("Receive rate limit exceeded")
+
+	// ErrSendQueueFull is returned when messages for the peer back up in the
+	// queue configured with WithSendQueueSize, because the send callback can't
+	// keep up.
+	ErrSendQueueFull = errors.New("Send queue full")
+
+	// ErrUnexpectedRemote is returned when the remote address of the FiveTuple
+	// obtained isn't the one configured with WithExpectedRemote.
+	ErrUnexpectedRemote = errors.New("Unexpected remote address")
+
+	// ErrPeerAborted is returned when the peer aborts the traversal with a
+	// message recognized by the detector configured with WithAbortDetector.
+	ErrPeerAborted = errors.New("Traversal aborted by peer")
+
+	// ErrSymmetricNAT is wrapped by the TraversalError returned when natty
+	// reports that traversal failed because of a symmetric NAT, through which
+	// direct traversal won't succeed no matter how often it's retried. Callers
+	// seeing this should fall back to a relay (see WithTURNServer).
+	ErrSymmetricNAT = errors.New("Symmetric NAT detected")
+)
+
+// TraversalError is returned when natty itself fails to traverse, for example
+// because the peer's NAT doesn't permit it. Err is the underlying error, if
+// any, and Stderr holds the most recent output that natty wrote to stderr,
+// which usually explains why natty gave up. ExitCode is natty's exit status,
+// or -1 if natty reported the error without exiting.
+type TraversalError struct {
+	Message  string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+func (e *TraversalError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Error reported by natty: %s", e.Message)
+	}
+	return fmt.Sprintf("natty failed: %s", e.Err)
+}
+
+func (e *TraversalError) Unwrap() error {
+	return e.Err
+}
+
+// SendError is returned when the callback configured with WithSend fails to
+// send a message to the peer. Msg is the message that couldn't be sent and Err
+// is the error returned by the callback.
+type SendError struct {
+	Msg string
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("Unable to send message to peer: %s", e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when a Traversal gives up because the timeout
+// configured with WithTimeout or the deadline of the Context configured with
+// WithContext passed, as opposed to natty itself failing. Elapsed is how long
+// the Traversal had been running. Idle is true if natty stalled, producing no
+// output for longer than the idle timeout configured with WithIdleTimeout.
+// Watchdog is true if natty ran for longer than the maximum configured with
+// WithMaxProcessLifetime. TimeoutError unwraps to context.DeadlineExceeded.
+type TimeoutError struct {
+	Elapsed  time.Duration
+	Idle     bool
+	Watchdog bool
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Watchdog {
+		return fmt.Sprintf("Stopped natty after it exceeded its maximum lifetime, running for %v", e.Elapsed)
+	}
+	if e.Idle {
+		return fmt.Sprintf("Timed out waiting for output from natty after %v", e.Elapsed)
+	}
+	return fmt.Sprintf("Timed out waiting for five-tuple after %v", e.Elapsed)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
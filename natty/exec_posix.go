@@ -0,0 +1,11 @@
+//go:build !windows
+
+package natty
+
+import (
+	"syscall"
+)
+
+// errExecFormat is the error with which starting a binary built for another
+// platform fails.
+var errExecFormat error = syscall.ENOEXEC
@@ -0,0 +1,9 @@
+package natty
+
+import (
+	"syscall"
+)
+
+// errExecFormat is the error with which starting a binary built for another
+// platform fails, ERROR_BAD_EXE_FORMAT.
+var errExecFormat error = syscall.Errno(193)
@@ -0,0 +1,20 @@
+package natty
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkExecutable makes sure that the filesystem containing dir isn't mounted
+// noexec.
+func checkExecutable(dir string) error {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return err
+	}
+	if stat.Flags&syscall.MS_NOEXEC != 0 {
+		return fmt.Errorf("directory is mounted noexec")
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package natty
+
+// checkExecutable is a no-op on platforms where we can't easily tell whether
+// dir is mounted noexec.
+func checkExecutable(dir string) error {
+	return nil
+}
@@ -0,0 +1,225 @@
+package natty
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// fiveTupleType is the type that natty uses for 5-tuple messages.
+const fiveTupleType = "5-tuple"
+
+// String returns a human-readable representation of this FiveTuple like
+// "udp 10.0.0.1:5000->203.0.113.5:6000".
+func (ft *FiveTuple) String() string {
+	if ft == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s %s->%s", ft.Proto, ft.Local, ft.Remote)
+}
+
+// MarshalJSON marshals this FiveTuple the same way that natty itself does,
+// including the message type, so that the result can be unmarshaled again or
+// passed to MsgIn like a 5-tuple that natty emitted.
+func (ft *FiveTuple) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type   string   `json:"type"`
+		Proto  Protocol `json:"proto"`
+		Local  string   `json:"local"`
+		Remote string   `json:"remote"`
+	}{fiveTupleType, ft.Proto, ft.Local, ft.Remote})
+}
+
+// LocalAddr returns the Local address of this FiveTuple as a *net.UDPAddr if
+// Proto is UDP or as a *net.TCPAddr if Proto is TCP.
+func (ft *FiveTuple) LocalAddr() (net.Addr, error) {
+	return ft.addr(ft.Local)
+}
+
+// RemoteAddr returns the Remote address of this FiveTuple as a *net.UDPAddr if
+// Proto is UDP or as a *net.TCPAddr if Proto is TCP.
+func (ft *FiveTuple) RemoteAddr() (net.Addr, error) {
+	return ft.addr(ft.Remote)
+}
+
+// Canonical returns a copy of this FiveTuple with its protocol and addresses
+// normalized, so that for example "[::ffff:1.2.3.4]:5000" becomes
+// "1.2.3.4:5000" and "[2001:DB8::0:1]:5000" becomes "[2001:db8::1]:5000".
+// Addresses that can't be parsed are left as they are. Canonical of a nil
+// FiveTuple is nil.
+func (ft *FiveTuple) Canonical() *FiveTuple {
+	if ft == nil {
+		return nil
+	}
+	return &FiveTuple{
+		Proto:  Protocol(strings.ToLower(string(ft.Proto))),
+		Local:  canonicalHostPort(ft.Local),
+		Remote: canonicalHostPort(ft.Remote),
+	}
+}
+
+// Equal reports whether this FiveTuple and other are the same after
+// normalization (see Canonical). Two nil FiveTuples are equal, but a nil
+// FiveTuple doesn't equal a non-nil one.
+func (ft *FiveTuple) Equal(other *FiveTuple) bool {
+	if ft == nil || other == nil {
+		return ft == nil && other == nil
+	}
+	return *ft.Canonical() == *other.Canonical()
+}
+
+func canonicalHostPort(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(host)
+	}
+	if p, err := strconv.Atoi(port); err == nil {
+		port = strconv.Itoa(p)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// IsIPv6 reports whether either end of this FiveTuple has an IPv6 address, as
+// can happen on dual-stack hosts. IPv4-mapped IPv6 addresses like
+// [::ffff:10.0.0.1] count as IPv4.
+func (ft *FiveTuple) IsIPv6() bool {
+	return isIPv6(ft.Local) || isIPv6(ft.Remote)
+}
+
+// Family returns the address family of the path described by this FiveTuple,
+// "ipv6" if either end has an IPv6 address (see IsIPv6) or "ipv4" otherwise.
+// IPv4-mapped IPv6 addresses like [::ffff:10.0.0.1] count as IPv4. If neither
+// address is an IP address, Family returns the empty string.
+func (ft *FiveTuple) Family() string {
+	if ft == nil {
+		return ""
+	}
+	if ft.IsIPv6() {
+		return "ipv6"
+	}
+	if hostIP(ft.Local) != nil || hostIP(ft.Remote) != nil {
+		return "ipv4"
+	}
+	return ""
+}
+
+func isIPv6(hostport string) bool {
+	ip := hostIP(hostport)
+	return ip != nil && ip.To4() == nil
+}
+
+// hostIP parses the host of hostport as an IP address, returning nil if it
+// isn't one.
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (ft *FiveTuple) addr(hostport string) (net.Addr, error) {
+	// Split first so that we can give a clear error for malformed addresses.
+	// SplitHostPort takes care of bracketed IPv6 literals.
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return nil, fmt.Errorf("Unable to split host and port of %s: %s", hostport, err)
+	}
+
+	switch ft.Proto {
+	case UDP:
+		addr, err := net.ResolveUDPAddr("udp", hostport)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve UDP address %s: %s", hostport, err)
+		}
+		return addr, nil
+	case TCP:
+		addr, err := net.ResolveTCPAddr("tcp", hostport)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve TCP address %s: %s", hostport, err)
+		}
+		return addr, nil
+	default:
+		return nil, fmt.Errorf("Unknown protocol %s", ft.Proto)
+	}
+}
+
+// Dial opens a connection from the Local address of this FiveTuple to its
+// Remote address. For UDP, this returns a *net.UDPConn and for TCP a
+// *net.TCPConn. Either way, the socket is bound to Local with SO_REUSEADDR and,
+// on Linux and the BSDs, SO_REUSEPORT set, so that it can reuse the port that
+// natty used during traversal, and so that connections from several
+// traversals can share the same local port.
+func (ft *FiveTuple) Dial() (net.Conn, error) {
+	local, err := ft.LocalAddr()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ft.RemoteAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		LocalAddr: local,
+		Control:   reuseAddrPort,
+	}
+	switch ft.Proto {
+	case UDP:
+		conn, err := dialer.Dial("udp", remote.String())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to dial UDP from %s to %s: %s", ft.Local, ft.Remote, err)
+		}
+		return conn, nil
+	default:
+		conn, err := dialer.Dial("tcp", remote.String())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to dial TCP from %s to %s: %s", ft.Local, ft.Remote, err)
+		}
+		return conn, nil
+	}
+}
+
+// parseIPOrCIDR parses a single IP address or a CIDR range, returning a single
+// address as a range containing only that address.
+func parseIPOrCIDR(ipOrCIDR string) (*net.IPNet, error) {
+	if strings.Contains(ipOrCIDR, "/") {
+		_, ipNet, err := net.ParseCIDR(ipOrCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expected remote %q: %s", ipOrCIDR, err)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(ipOrCIDR)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid expected remote %q", ipOrCIDR)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// checkRemote makes sure that the host of remote (a host:port) is within
+// expected (see WithExpectedRemote).
+func checkRemote(remote string, expected string) error {
+	ipNet, err := parseIPOrCIDR(expected)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ipNet.Contains(ip) {
+		return fmt.Errorf("%w: %s is not in %s", ErrUnexpectedRemote, remote, expected)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package natty
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrs(t *testing.T) {
+	ft := &FiveTuple{UDP, "10.0.0.1:5000", "[2001:db8::1]:6000"}
+	local, err := ft.LocalAddr()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, local)
+	}
+	remote, err := ft.RemoteAddr()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6000}, remote)
+	}
+
+	ft.Proto = TCP
+	local, err = ft.LocalAddr()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, local)
+	}
+
+	ft.Local = "2001:db8::1:5000"
+	_, err = ft.LocalAddr()
+	assert.Error(t, err, "Unbracketed IPv6 address should fail")
+
+	ft.Proto = Protocol("sctp")
+	_, err = ft.RemoteAddr()
+	assert.Error(t, err, "Unknown protocol should fail")
+}
+
+func TestDialUDP(t *testing.T) {
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer remote.Close()
+
+	ft := &FiveTuple{UDP, "127.0.0.1:0", remote.LocalAddr().String()}
+	conn, err := ft.Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, ok := conn.(*net.UDPConn)
+	assert.True(t, ok, "UDP Dial should return a UDPConn")
+
+	_, err = conn.Write([]byte(MessageText))
+	assert.NoError(t, err)
+	b := make([]byte, 100)
+	n, addr, err := remote.ReadFrom(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, MessageText, string(b[:n]))
+		assert.Equal(t, conn.LocalAddr().String(), addr.String())
+	}
+}
+
+func TestDialTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	ft := &FiveTuple{TCP, "127.0.0.1:0", l.Addr().String()}
+	conn, err := ft.Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, ok := conn.(*net.TCPConn)
+	assert.True(t, ok, "TCP Dial should return a TCPConn")
+}
+
+func TestDialSharedPort(t *testing.T) {
+	for _, proto := range []Protocol{UDP, TCP} {
+		var remotes []string
+		for i := 0; i < 2; i++ {
+			if proto == UDP {
+				remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+				if err != nil {
+					t.Fatalf("Unable to listen: %s", err)
+				}
+				defer remote.Close()
+				remotes = append(remotes, remote.LocalAddr().String())
+			} else {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatalf("Unable to listen: %s", err)
+				}
+				defer l.Close()
+				remotes = append(remotes, l.Addr().String())
+			}
+		}
+
+		first, err := (&FiveTuple{proto, "127.0.0.1:0", remotes[0]}).Dial()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		defer first.Close()
+		second, err := (&FiveTuple{proto, first.LocalAddr().String(), remotes[1]}).Dial()
+		if assert.NoError(t, err, "%s connections should be able to share the local port", proto) {
+			second.Close()
+		}
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	ft := &FiveTuple{}
+	err := json.Unmarshal([]byte(`{"type":"5-tuple","proto":"udp","local":"[2001:db8::1]:5000","remote":"203.0.113.5:6000"}`), ft)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, ft.IsIPv6(), "Tuple with IPv6 local address should be IPv6")
+	local, err := ft.LocalAddr()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, local)
+	}
+	remote, err := ft.RemoteAddr()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6000}, remote)
+	}
+
+	assert.False(t, (&FiveTuple{UDP, "10.0.0.1:5000", "203.0.113.5:6000"}).IsIPv6(), "IPv4 tuple should not be IPv6")
+	assert.False(t, (&FiveTuple{UDP, "[::ffff:10.0.0.1]:5000", "203.0.113.5:6000"}).IsIPv6(), "IPv4-mapped tuple should not be IPv6")
+}
+
+func TestFamily(t *testing.T) {
+	assert.Equal(t, "ipv4", (&FiveTuple{UDP, "10.0.0.1:5000", "203.0.113.5:6000"}).Family())
+	assert.Equal(t, "ipv6", (&FiveTuple{UDP, "[2001:db8::1]:5000", "[2001:db8::2]:6000"}).Family())
+	assert.Equal(t, "ipv4", (&FiveTuple{UDP, "[::ffff:10.0.0.1]:5000", "[::ffff:203.0.113.5]:6000"}).Family(), "IPv4-mapped addresses should count as IPv4")
+	assert.Equal(t, "", (&FiveTuple{UDP, "host:5000", "other:6000"}).Family())
+	assert.Equal(t, "", (*FiveTuple)(nil).Family())
+}
+
+func TestFiveTupleJSON(t *testing.T) {
+	line := `{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"203.0.113.5:6000"}`
+	ft := &FiveTuple{}
+	if !assert.NoError(t, json.Unmarshal([]byte(line), ft)) {
+		return
+	}
+	assert.Equal(t, &FiveTuple{UDP, "10.0.0.1:5000", "203.0.113.5:6000"}, ft)
+	assert.Equal(t, "udp 10.0.0.1:5000->203.0.113.5:6000", ft.String())
+
+	b, err := json.Marshal(ft)
+	if assert.NoError(t, err) {
+		assert.Equal(t, line, string(b), "Marshaled FiveTuple should match natty's output")
+		assert.True(t, IsFiveTuple(string(b)))
+	}
+
+	var nilFT *FiveTuple
+	assert.Equal(t, "<nil>", nilFT.String())
+}
+
+func TestEqual(t *testing.T) {
+	a := &FiveTuple{UDP, "[::ffff:1.2.3.4]:5000", "[2001:DB8::0:1]:06000"}
+	b := &FiveTuple{"UDP", "1.2.3.4:5000", "[2001:db8::1]:6000"}
+	assert.Equal(t, b.Local, a.Canonical().Local)
+	assert.Equal(t, &FiveTuple{UDP, "1.2.3.4:5000", "[2001:db8::1]:6000"}, a.Canonical())
+	assert.True(t, a.Equal(b))
+	assert.True(t, b.Equal(a))
+	assert.False(t, a.Equal(&FiveTuple{TCP, "1.2.3.4:5000", "[2001:db8::1]:6000"}))
+	assert.False(t, a.Equal(&FiveTuple{UDP, "1.2.3.4:5001", "[2001:db8::1]:6000"}))
+
+	var nilFT *FiveTuple
+	assert.True(t, nilFT.Equal(nil))
+	assert.False(t, nilFT.Equal(a))
+	assert.False(t, a.Equal(nil))
+	assert.Nil(t, nilFT.Canonical())
+
+	unparseable := &FiveTuple{UDP, "garbage", "Example.com:80"}
+	assert.Equal(t, &FiveTuple{UDP, "garbage", "example.com:80"}, unparseable.Canonical())
+}
+
+func TestFiveTupleDecoder(t *testing.T) {
+	traverse := func(t *testing.T, decoder FiveTupleDecoder, local string, remote string) *FiveTuple {
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "echo '"+local+"'\nexec sleep 30")), WithFiveTupleDecoder(decoder))
+		defer offer.Close()
+		<-offer.Messages()
+		assert.NoError(t, offer.MsgIn(remote))
+		ft, err := offer.FiveTuple()
+		assert.NoError(t, err)
+		return ft
+	}
+
+	nested := func(msg []byte) (*FiveTuple, error) {
+		var wrapper struct {
+			Result *FiveTuple `json:"result"`
+		}
+		if err := json.Unmarshal(msg, &wrapper); err != nil {
+			return nil, err
+		}
+		return wrapper.Result, nil
+	}
+	ft := traverse(t, nested,
+		`{"type":"5-tuple","result":{"proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}}`,
+		`{"type":"5-tuple","result":{"proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}}`)
+	assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+
+	renamed := func(msg []byte) (*FiveTuple, error) {
+		var result struct {
+			Event    string   `json:"event"`
+			Protocol Protocol `json:"protocol"`
+			Src      string   `json:"src"`
+			Dst      string   `json:"dst"`
+		}
+		if err := json.Unmarshal(msg, &result); err != nil {
+			return nil, err
+		}
+		return &FiveTuple{result.Protocol, result.Src, result.Dst}, nil
+	}
+	ft = traverse(t, renamed,
+		`{"event":"connected","protocol":"tcp","src":"127.0.0.1:3","dst":"127.0.0.1:4","rtt":12}`,
+		`{"event":"connected","protocol":"tcp","src":"127.0.0.1:4","dst":"127.0.0.1:3","rtt":12}`)
+	assert.Equal(t, "tcp 127.0.0.1:3->127.0.0.1:4", ft.String(), "Decoder should also recognize 5-tuples without the marker")
+
+	failing := func(msg []byte) (*FiveTuple, error) {
+		return nil, nil
+	}
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, `echo '{"type":"5-tuple"}'; exec sleep 30`)), WithFiveTupleDecoder(failing))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.True(t, errors.Is(err, ErrMalformedFiveTuple), "Undecodable 5-tuple should be malformed, not %v", err)
+}
+
+func TestCheckRemote(t *testing.T) {
+	assert.NoError(t, checkRemote("203.0.113.5:6000", "203.0.113.5"))
+	assert.NoError(t, checkRemote("[::ffff:203.0.113.5]:6000", "203.0.113.5"), "IPv4-mapped address should match")
+	assert.NoError(t, checkRemote("203.0.113.77:6000", "203.0.113.0/24"))
+	assert.NoError(t, checkRemote("[2001:db8::1]:6000", "2001:db8::/32"))
+	assert.NoError(t, checkRemote("[2001:db8::1]:6000", "2001:DB8::0:1"))
+
+	for _, remote := range []string{"203.0.113.6:6000", "198.51.100.7:6000", "[2001:db8::2]:6000", "not-an-ip:6000"} {
+		err := checkRemote(remote, "203.0.113.5")
+		assert.True(t, errors.Is(err, ErrUnexpectedRemote), "%s shouldn't match, got %v", remote, err)
+	}
+	err := checkRemote("203.0.113.5:6000", "203.0.113.0/33")
+	assert.False(t, errors.Is(err, ErrUnexpectedRemote), "Invalid CIDR should be reported as such, not %v", err)
+	assert.Error(t, err)
+}
+
+func TestExpectedRemote(t *testing.T) {
+	script := `echo '{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"203.0.113.5:6000"}'
+exec sleep 30`
+	traverse := func(expected string) error {
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithExpectedRemote(expected))
+		defer offer.Close()
+		offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"203.0.113.5:6000","remote":"10.0.0.1:5000"}`)
+		_, err := offer.FiveTuple()
+		return err
+	}
+	assert.NoError(t, traverse("203.0.113.0/24"))
+	err := traverse("198.51.100.0/24")
+	assert.True(t, errors.Is(err, ErrUnexpectedRemote), "Remote outside expected range should be rejected, not %v", err)
+	err = traverse("bogus")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid expected remote")
+	}
+}
+
+func TestFiveTupleDecoderPanic(t *testing.T) {
+	panicky := func(msg []byte) (*FiveTuple, error) {
+		panic("boom")
+	}
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`)),
+		WithFiveTupleDecoder(panicky))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.True(t, errors.Is(err, ErrMalformedFiveTuple), "Panicking decoder should give ErrMalformedFiveTuple, not %v", err) {
+		assert.Contains(t, err.Error(), "Unexpected panic in five-tuple decoder: boom")
+	}
+	assert.Contains(t, offer.LastError(), "Unexpected panic in five-tuple decoder: boom")
+}
@@ -0,0 +1,27 @@
+package natty
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// requireFlag makes sure that the natty binary supports the given flag, based
+// on the usage that it prints in response to -help, in which flags are listed
+// like "  --offer (Generates an offer) ...". This way, Options that depend on
+// newer natty features fail clearly instead of natty choking on an unknown
+// flag or, worse, silently ignoring it. See runHelper.
+func (t *Traversal) requireFlag(flag string) error {
+	usage, err := t.runHelper("-help")
+	if err != nil {
+		return err
+	}
+	if usage == "" {
+		return fmt.Errorf("Unable to get natty usage: no output")
+	}
+
+	pattern := regexp.MustCompile(`(?m)^\s*--?` + regexp.QuoteMeta(flag) + `\b`)
+	if !pattern.MatchString(usage) {
+		return fmt.Errorf("natty binary does not support -%s", flag)
+	}
+	return nil
+}
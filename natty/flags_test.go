@@ -0,0 +1,112 @@
+package natty
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUsage is a script printing the usage of the bundled natty, plus any
+// flag lines substituted for %s, in response to -help.
+const fakeUsage = `if [ "$1" = "-help" ]; then
+  cat <<'USAGE'
+Flags from ../../../../src/natty/flagdefs.h:
+  --autocall (Call the first available other client on the server without user intervention.  Note: this flag should only be set to true on one of the two clients.)  type: bool  default: false
+  --port (The port on which the server is listening.)  type: int  default: 8000
+  --stuns (List of STUN servers natty will use to gather ICE candidates)  type: string  default: stun:stun.l.google.com:19302
+  --server (The server to connect to.)  type: string  default: localhost
+  --out (Natty stdout)  type: string  default:
+  --autoconnect (Connect to the server without user intervention.)  type: bool  default: false
+  --debug (Log debugging info)  type: bool  default: false
+  --offer (Generates an offer)  type: bool  default: false
+  --help (Prints this message)  type: bool  default: false
+%s
+USAGE
+  exit 0
+fi
+echo "args: $@" >&2`
+
+// fakeTURNUsage are the usage lines for the TURN flags, which the bundled
+// natty lacks.
+const fakeTURNUsage = `  --turn (TURN server to relay through)  type: string  default:
+  --turnuser (TURN user)  type: string  default:
+  --turnpass (TURN password)  type: string  default:`
+
+func TestLocalInterface(t *testing.T) {
+	supported := fakeNatty(t, fmt.Sprintf(fakeUsage, "  --bind (IP of the local interface to bind to)  type: string  default: "))
+	offer := OfferWithOptions(WithBinaryPath(supported), WithLocalInterface("10.0.0.5"))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err)
+	assert.Contains(t, offer.LastError(), "-bind 10.0.0.5")
+
+	invalid := OfferWithOptions(WithBinaryPath(supported), WithLocalInterface("not an ip"))
+	defer invalid.Close()
+	_, err = invalid.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid local interface IP")
+	}
+
+	unsupported := fakeNatty(t, fmt.Sprintf(fakeUsage, "  --binder (Binds things)  type: bool  default: false"))
+	old := OfferWithOptions(WithBinaryPath(unsupported), WithLocalInterface("10.0.0.5"))
+	defer old.Close()
+	_, err = old.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support -bind")
+	}
+	assert.Empty(t, old.LastError(), "natty should not have been run")
+}
+
+func TestForceRelay(t *testing.T) {
+	supported := fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage+"\n  --relay (Only gather relay candidates)  type: bool  default: false")+`
+echo '{"type":"candidate","candidate":"candidate:1 1 udp 16777215 198.51.100.7 7000 typ relay raddr 0.0.0.0 rport 0"}'
+echo '{"type":"5-tuple","proto":"udp","local":"198.51.100.7:7000","remote":"10.0.0.1:5000"}'
+exec sleep 30`)
+	offer := OfferWithOptions(WithBinaryPath(supported), WithTURNServer("turn.example.com:3478", "user", "pass"), WithForceRelay())
+	defer offer.Close()
+	for msg := range offer.Messages() {
+		if IsFiveTuple(msg) {
+			assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"10.0.0.1:5000","remote":"198.51.100.7:7000"}`))
+		}
+	}
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+	assert.Contains(t, offer.LastError(), " -relay")
+	assert.True(t, offer.Stats().Relayed)
+	pair, ok := offer.SelectedPair()
+	assert.True(t, ok)
+	assert.True(t, pair.Relayed(), "Selected pair should be relayed")
+
+	noTURN := OfferWithOptions(WithBinaryPath(supported), WithForceRelay())
+	defer noTURN.Close()
+	_, err = noTURN.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "without a TURN server")
+	}
+
+	unsupported := fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage+"\n  --relayed (Relays things)  type: bool  default: false"))
+	old := OfferWithOptions(WithBinaryPath(unsupported), WithTURNServer("turn.example.com:3478", "user", "pass"), WithForceRelay())
+	defer old.Close()
+	_, err = old.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support -relay")
+	}
+	assert.Empty(t, old.LastError(), "natty should not have been run")
+}
+
+func TestRequireFlag(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	path := fakeNatty(t, `echo run >> `+count+`
+`+fmt.Sprintf(fakeUsage, "  -relay\n    \tonly gather relay candidates"))
+	traversal := New(WithBinaryPath(path))
+	assert.NoError(t, traversal.requireFlag("offer"), "--flag style should be recognized")
+	assert.NoError(t, traversal.requireFlag("relay"), "-flag style should be recognized")
+	assert.Error(t, traversal.requireFlag("bind"))
+	assert.Error(t, traversal.requireFlag("off"))
+	assert.NoError(t, New(WithBinaryPath(path)).requireFlag("stuns"))
+	b, _ := os.ReadFile(count)
+	assert.Equal(t, "run\n", string(b), "natty should only be asked for its usage once")
+}
@@ -0,0 +1,149 @@
+package natty
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Framing determines how messages are delimited on natty's stdin and stdout.
+// See WithFraming.
+type Framing int
+
+const (
+	// FramingNewline delimits each message with a newline. This is the
+	// default, and is what natty itself uses.
+	FramingNewline Framing = iota
+	// FramingLengthPrefixed precedes each message with its length in bytes,
+	// as a 4 byte big-endian unsigned integer, with no trailing delimiter.
+	// Messages framed this way may contain newlines.
+	FramingLengthPrefixed
+)
+
+func (f Framing) String() string {
+	switch f {
+	case FramingNewline:
+		return "newline"
+	case FramingLengthPrefixed:
+		return "length-prefixed"
+	default:
+		return "unknown"
+	}
+}
+
+// readMessage reads the next message from natty's stdout using our Framing.
+// Regardless of framing, messages are returned with a trailing newline, so
+// that consumers of NextMsgOut() see the same thing either way.
+func (t *Traversal) readMessage() (string, error) {
+	if t.framing == FramingLengthPrefixed {
+		return readLengthPrefixedMessage(t.stdoutbuf)
+	}
+	return readMessage(t.stdoutbuf)
+}
+
+// readLengthPrefixedMessage reads the next length-prefixed message from r.
+// Like readMessage, JSON messages are returned in compact form.
+func readLengthPrefixedMessage(r *bufio.Reader) (string, error) {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	if length > maxMessageSize {
+		return "", fmt.Errorf("Message from natty of %d bytes exceeds maximum of %d", length, maxMessageSize)
+	}
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return "", err
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, msg) == nil {
+		msg = compacted.Bytes()
+	}
+	return string(msg) + "\n", nil
+}
+
+// writeMessage writes msg to natty's stdin using our Framing.
+func (t *Traversal) writeMessage(msg string) error {
+	var frame []byte
+	if t.framing == FramingLengthPrefixed {
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(msg)))
+		frame = append(prefix[:], msg...)
+	} else {
+		frame = []byte(msg + "\n")
+	}
+	if t.stdinWriter != nil {
+		return t.stdinWriter.WriteFrame(frame)
+	}
+	_, err := t.stdin.Write(frame)
+	return err
+}
+
+// frameWriter buffers whole frames on their way to w (see
+// WithBufferedStdin). A frame that doesn't fit in the rest of the buffer is
+// only written after flushing what's already buffered, so frames are never
+// split across writes to w unless they're bigger than the buffer itself.
+type frameWriter struct {
+	w     *bufio.Writer
+	mutex sync.Mutex
+}
+
+func newFrameWriter(w io.Writer, size int) *frameWriter {
+	return &frameWriter{w: bufio.NewWriterSize(w, size)}
+}
+
+// WriteFrame buffers frame, flushing first if it doesn't fit.
+func (fw *frameWriter) WriteFrame(frame []byte) error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if len(frame) > fw.w.Available() && fw.w.Buffered() > 0 {
+		err := fw.w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	// An empty buffer writes frames that are too big for it straight through
+	_, err := fw.w.Write(frame)
+	return err
+}
+
+// Flush writes any buffered frames to w.
+func (fw *frameWriter) Flush() error {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return fw.w.Flush()
+}
+
+// flushStdin periodically flushes the messages buffered for natty's stdin
+// until the current attempt stops.
+func (t *Traversal) flushStdin(fw *frameWriter, stopCh chan struct{}) {
+	defer t.incomingwg.Done()
+
+	ticker := time.NewTicker(t.stdinFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := fw.Flush()
+			if isClosedPipe(err) {
+				log.Tracef("natty's stdin is closed, no longer flushing messages: %s", err)
+				t.sendErr(ErrClosed)
+				return
+			}
+			if err != nil {
+				log.Tracef("Unable to flush messages to natty process: %s", err)
+				t.sendErr(err)
+				return
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package natty
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeLengthPrefixed(w io.Writer, msg string) {
+	binary.Write(w, binary.BigEndian, uint32(len(msg)))
+	io.WriteString(w, msg)
+}
+
+func TestLengthPrefixedFraming(t *testing.T) {
+	var received string
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		writeLengthPrefixed(stdout, "{\n\"type\": \"offer\",\n\"sdp\": \"o\"\n}")
+		received, _ = readLengthPrefixedMessage(stdin)
+		writeLengthPrefixed(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`)
+		// Run until killed
+		stdin.ReadByte()
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)), WithFraming(FramingLengthPrefixed))
+	defer offer.Close()
+
+	assert.Equal(t, "{\"type\":\"offer\",\"sdp\":\"o\"}\n", <-offer.Messages())
+	assert.NoError(t, offer.MsgIn("{\"type\":\"answer\",\n\"sdp\":\"a\"}"), "Length-prefixed messages may contain newlines")
+	assert.True(t, IsFiveTuple(<-offer.Messages()))
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"type\":\"answer\",\"sdp\":\"a\"}\n", received)
+}
+
+func TestLengthPrefixedFramingTrailingNewline(t *testing.T) {
+	received := make(chan string, 1)
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		writeLengthPrefixed(stdout, `{"type":"offer","sdp":"o"}`)
+		var length uint32
+		if binary.Read(stdin, binary.BigEndian, &length) == nil {
+			msg := make([]byte, length)
+			io.ReadFull(stdin, msg)
+			received <- string(msg)
+		}
+		// Run until killed
+		stdin.ReadByte()
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)), WithFraming(FramingLengthPrefixed))
+	defer offer.Close()
+
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn("binary\x00payload\r\n"))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "binary\x00payload\r\n", msg, "Length-prefixed messages should reach natty unchanged")
+	case <-time.After(5 * time.Second):
+		t.Fatal("natty didn't receive message")
+	}
+}
+
+func TestReadLengthPrefixedMessage(t *testing.T) {
+	var buf bytes.Buffer
+	writeLengthPrefixed(&buf, "plain text")
+	binary.Write(&buf, binary.BigEndian, uint32(maxMessageSize+1))
+	r := bufio.NewReader(&buf)
+
+	msg, err := readLengthPrefixedMessage(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain text\n", msg)
+	_, err = readLengthPrefixedMessage(r)
+	assert.Error(t, err, "Oversized message should be rejected")
+	assert.Equal(t, "length-prefixed", FramingLengthPrefixed.String())
+}
+
+// writeRecorder records each write made to it.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestFrameWriter(t *testing.T) {
+	w := &writeRecorder{}
+	fw := newFrameWriter(w, 16)
+	assert.NoError(t, fw.WriteFrame([]byte("one\n")))
+	assert.NoError(t, fw.WriteFrame([]byte("two\n")))
+	assert.Empty(t, w.writes, "Frames should be buffered")
+	assert.NoError(t, fw.WriteFrame([]byte("three four\n")))
+	assert.Equal(t, []string{"one\ntwo\n"}, w.writes, "Frame that doesn't fit should flush whole frames first")
+	assert.NoError(t, fw.WriteFrame([]byte("a frame bigger than the buffer\n")))
+	assert.NoError(t, fw.Flush())
+	assert.Equal(t, []string{"one\ntwo\n", "three four\n", "a frame bigger than the buffer\n"}, w.writes)
+}
+
+func TestBufferedStdin(t *testing.T) {
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithBufferedStdin(200*time.Millisecond))
+	defer offer.Close()
+	<-offer.Messages()
+
+	start := time.Now()
+	assert.NoError(t, offer.MsgIn("one"))
+	assert.NoError(t, offer.MsgIn("two"))
+	select {
+	case msg := <-offer.Messages():
+		t.Fatalf("Message should be buffered, got %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "one\n", <-offer.Messages())
+	assert.True(t, time.Since(start) < 2*time.Second, "Messages should be flushed periodically")
+	assert.Equal(t, "two\n", <-offer.Messages())
+}
@@ -0,0 +1,161 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// helperTimeout bounds how long natty may take to answer a helper run like
+	// -version, for Traversals without a shorter timeout of their own.
+	helperTimeout = 10 * time.Second
+
+	// helperWaitDelay is how long to wait for the output of a helper run that
+	// was stopped, in case natty left behind children holding its pipes.
+	helperWaitDelay = time.Second
+)
+
+var (
+	helperOutputs      = make(map[string]string) // output of completed helper runs, by binary path and params
+	helperOutputsMutex sync.Mutex
+)
+
+// runHelper runs natty with params, like -version or -help, through the
+// Traversal's commandRunner (so that simulated and fake natty commands answer
+// too), returning everything that it wrote to stdout and stderr. The run is
+// stopped if it takes longer than the Traversal's timeout (or helperTimeout),
+// its Context is done or it's closed. Since the answer only depends on the
+// binary, the output of a completed run of a natty binary is cached per
+// binary, and natty isn't run again for the same params.
+func (t *Traversal) runHelper(params ...string) (string, error) {
+	cmd, err := t.runner(t, params)
+	if err != nil {
+		return "", err
+	}
+	var key string
+	if ec, ok := cmd.(*execCommand); ok {
+		key = strings.Join(ec.Args, " ")
+		helperOutputsMutex.Lock()
+		out, cached := helperOutputs[key]
+		helperOutputsMutex.Unlock()
+		if cached {
+			discardCommand(cmd)
+			return out, nil
+		}
+	}
+
+	ctx, cancel := t.helperContext()
+	defer cancel()
+	b, err := runHelperCommand(ctx, cmd)
+	if ctx.Err() != nil {
+		select {
+		case <-t.closedChan():
+			return "", ErrClosed
+		default:
+		}
+		return "", fmt.Errorf("Unable to run natty %s: %w", strings.Join(params, " "), ctx.Err())
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to run natty %s: %s", strings.Join(params, " "), err)
+	}
+
+	out := string(b)
+	if key != "" {
+		helperOutputsMutex.Lock()
+		helperOutputs[key] = out
+		helperOutputsMutex.Unlock()
+	}
+	return out, nil
+}
+
+// runHelperCommand runs cmd to completion and returns everything that it wrote
+// to stdout and stderr. If ctx is done first, cmd is killed, and its output is
+// abandoned after helperWaitDelay in case natty left behind children holding
+// its pipes.
+func runHelperCommand(ctx context.Context, cmd command) ([]byte, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		discardCommand(cmd)
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdout.Close()
+		discardCommand(cmd)
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	out := &lockedWriter{w: &buf}
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			io.Copy(out, r)
+		}(r)
+	}
+	copiedCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(copiedCh)
+	}()
+
+	select {
+	case <-copiedCh:
+	case <-ctx.Done():
+		cmd.Kill()
+		select {
+		case <-copiedCh:
+		case <-time.After(helperWaitDelay):
+			stdout.Close()
+			stderr.Close()
+			<-copiedCh
+		}
+	}
+	// natty may exit with a non-zero status after answering, for example
+	// after printing its usage, so the output is what counts.
+	err = cmd.Wait()
+	if err != nil {
+		log.Tracef("natty helper exited with %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// helperContext returns a Context for running natty's helpers, which is done
+// once the Traversal's Context is, its timeout (or helperTimeout) passes or
+// it's closed.
+func (t *Traversal) helperContext() (context.Context, context.CancelFunc) {
+	timeout := helperTimeout
+	if t.timeout > 0 && t.timeout < timeout {
+		timeout = t.timeout
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	closedCh := t.closedChan()
+	go func() {
+		select {
+		case <-closedCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// closedChan returns closedCh, which is nil until the Traversal is started.
+func (t *Traversal) closedChan() chan struct{} {
+	t.procMutex.Lock()
+	defer t.procMutex.Unlock()
+	return t.closedCh
+}
@@ -0,0 +1,20 @@
+package natty
+
+import (
+	"time"
+)
+
+// ResourceLimits caps the resources that the natty process may consume. Zero
+// values mean no limit.
+type ResourceLimits struct {
+	// MaxMemoryBytes limits the size of natty's virtual address space.
+	MaxMemoryBytes uint64
+	// MaxCPUTime limits how much CPU time natty may use, rounded up to whole
+	// seconds. natty is killed once it exceeds this.
+	MaxCPUTime time.Duration
+}
+
+// cpuSeconds returns MaxCPUTime rounded up to whole seconds.
+func (l ResourceLimits) cpuSeconds() uint64 {
+	return uint64((l.MaxCPUTime + time.Second - 1) / time.Second)
+}
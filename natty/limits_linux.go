@@ -0,0 +1,33 @@
+package natty
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// applyResourceLimits applies limits to the already running process pid.
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	if limits.MaxMemoryBytes > 0 {
+		err := prlimit(pid, syscall.RLIMIT_AS, limits.MaxMemoryBytes)
+		if err != nil {
+			return fmt.Errorf("Unable to limit memory of natty process: %s", err)
+		}
+	}
+	if limits.MaxCPUTime > 0 {
+		err := prlimit(pid, syscall.RLIMIT_CPU, limits.cpuSeconds())
+		if err != nil {
+			return fmt.Errorf("Unable to limit CPU time of natty process: %s", err)
+		}
+	}
+	return nil
+}
+
+func prlimit(pid int, resource int, limit uint64) error {
+	rlimit := syscall.Rlimit{Cur: limit, Max: limit}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package natty
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceLimits(t *testing.T) {
+	// Limits are applied before natty gets any input
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, "read line; ulimit -v >&2; ulimit -t >&2")),
+		WithResourceLimits(ResourceLimits{
+			MaxMemoryBytes: 512 * 1024 * 1024,
+			MaxCPUTime:     1500 * time.Millisecond,
+		}))
+	defer offer.Close()
+	assert.NoError(t, offer.MsgIn("go"))
+	offer.FiveTuple()
+	assert.Equal(t, []string{"524288", "2"}, strings.Fields(offer.LastError()))
+}
+
+func TestResourceLimitsArgs(t *testing.T) {
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo "args: $@" >&2; echo "pid: $$" >&2
+echo '{"type":"candidate","candidate":"a"}'
+exec sleep 30`)),
+		WithResourceLimits(ResourceLimits{MaxCPUTime: time.Second}))
+	defer offer.Close()
+	<-offer.Messages()
+	pid := offer.PID()
+	offer.Close()
+	assert.Equal(t, "args: -offer\npid: "+strconv.Itoa(pid)+"\n", offer.LastError(), "natty should be run directly with its own args")
+}
+
+func TestResourceLimitsIncompatibleBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "natty")
+	err := os.WriteFile(path, []byte{0x7f, 'E', 'L', 'F', 0, 0, 0, 0}, 0755)
+	if err != nil {
+		t.Fatalf("Unable to write binary: %s", err)
+	}
+	offer := OfferWithOptions(WithBinaryPath(path), WithResourceLimits(ResourceLimits{MaxCPUTime: time.Second}))
+	defer offer.Close()
+	_, err = offer.FiveTuple()
+	assert.True(t, errors.Is(err, ErrIncompatibleBinary), "Unrunnable binary should give ErrIncompatibleBinary, not %v", err)
+}
+
+func TestResourceLimitsFailure(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can raise its hard limits")
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CPU, &rlimit); err != nil || rlimit.Max == ^uint64(0) {
+		t.Skip("No hard CPU limit to exceed")
+	}
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `read line; echo "natty ran" >&2`)),
+		WithResourceLimits(ResourceLimits{MaxCPUTime: time.Duration(rlimit.Max+1) * time.Second}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unable to limit CPU time")
+	}
+	assert.Equal(t, -1, offer.PID(), "natty should have been killed")
+}
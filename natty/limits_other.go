@@ -0,0 +1,8 @@
+//go:build !linux
+
+package natty
+
+// applyResourceLimits is a no-op on platforms other than Linux.
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	return nil
+}
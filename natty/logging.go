@@ -0,0 +1,79 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logEvent logs a structured event to the slog.Logger configured with
+// WithLogger, if any.
+func (t *Traversal) logEvent(level slog.Level, msg string, args ...any) {
+	if t.logger == nil {
+		return
+	}
+	t.logger.Log(context.Background(), level, msg, args...)
+}
+
+// logMessage records a message sent to or received from the peer in the
+// message log configured with WithMessageLog, if any.
+func (t *Traversal) logMessage(direction string, msg string) {
+	if t.messageLog == nil {
+		return
+	}
+	msg = strings.TrimRight(msg, "\r\n")
+	line := fmt.Sprintf("%s %s %d", time.Now().Format(time.RFC3339Nano), direction, len(msg))
+	if t.messageLogContent {
+		line += " " + msg
+	}
+	_, err := io.WriteString(t.messageLog, line+"\n")
+	if err != nil {
+		log.Tracef("Unable to write to message log: %s", err)
+	}
+}
+
+// lineWriter is an io.Writer that calls onLine with each line written to it,
+// minus the trailing newline.
+type lineWriter struct {
+	onLine func(line string)
+	buf    []byte
+	mutex  sync.Mutex
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush passes on any trailing output that wasn't terminated by a newline.
+func (w *lineWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.buf) > 0 {
+		w.onLine(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// logStderrLine logs a line of natty's stderr output as a debug event.
+func (t *Traversal) logStderrLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line != "" {
+		t.logEvent(slog.LevelDebug, "natty stderr", "line", line)
+	}
+}
@@ -0,0 +1,77 @@
+package natty
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo '{"type":"candidate"}'; echo 'no route to peer' >&2; read msg; exit 1`)),
+		WithLogger(logger))
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn("hello"))
+	_, err := offer.FiveTuple()
+	assert.Error(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, `level=INFO msg="Traversal started"`)
+	assert.Contains(t, out, `level=DEBUG msg="Sent message to peer"`)
+	assert.Contains(t, out, `level=DEBUG msg="Received message from peer" msg=hello`)
+	assert.Contains(t, out, `level=DEBUG msg="natty stderr" line="no route to peer"`)
+	assert.Contains(t, out, `level=INFO msg="Traversal failed"`)
+	assert.Contains(t, out, `stderr="no route to peer\n"`)
+}
+
+func TestLogStderrLines(t *testing.T) {
+	var buf bytes.Buffer
+	tr := &Traversal{logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	w := &lineWriter{onLine: tr.logStderrLine}
+	w.Write([]byte("one\r\ntw"))
+	w.Write([]byte("o\n\nthree"))
+	w.Flush()
+	out := buf.String()
+	assert.Contains(t, out, "line=one\n")
+	assert.Contains(t, out, "line=two\n")
+	assert.Contains(t, out, "line=three\n")
+	assert.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("natty stderr")))
+}
+
+func TestMessageLog(t *testing.T) {
+	traverse := func(opts ...Option) []string {
+		var buf bytes.Buffer
+		offer := OfferWithOptions(append(opts, WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithMessageLog(&buf))...)
+		defer offer.Close()
+		<-offer.Messages()
+		assert.NoError(t, offer.MsgIn("hello"))
+		<-offer.Messages()
+		assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+		_, err := offer.FiveTuple()
+		assert.NoError(t, err)
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	lines := traverse()
+	expected := []string{"SEND 77", "RECV 5", "SEND 5", "RECV 77"}
+	if assert.Len(t, lines, len(expected)) {
+		for i, line := range lines {
+			parts := strings.SplitN(line, " ", 2)
+			_, err := time.Parse(time.RFC3339Nano, parts[0])
+			assert.NoError(t, err, "Line should start with a timestamp: %s", line)
+			assert.Equal(t, expected[i], parts[1], "Content shouldn't be logged by default")
+		}
+	}
+
+	lines = traverse(WithMessageLogContent())
+	if assert.Len(t, lines, len(expected)) {
+		assert.True(t, strings.HasSuffix(lines[1], " RECV 5 hello"), "Content should be logged when requested: %s", lines[1])
+	}
+}
@@ -0,0 +1,84 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MetricsHook receives notifications about Traversals, for example to record
+// them with Prometheus, without this package depending on any particular
+// metrics library. Methods may be called concurrently from different
+// Traversals and shouldn't block.
+type MetricsHook interface {
+	// TraversalStarted is called when a Traversal starts.
+	TraversalStarted()
+	// TraversalSucceeded is called when a Traversal obtains a FiveTuple,
+	// with how long that took.
+	TraversalSucceeded(d time.Duration)
+	// TraversalFailed is called when a Traversal fails, with a short,
+	// low-cardinality reason like "timeout" that's suitable as a label.
+	TraversalFailed(reason string)
+	// CandidateSent is called for each ICE candidate that is sent to the
+	// peer.
+	CandidateSent()
+}
+
+// Reasons passed to MetricsHook.TraversalFailed.
+const (
+	FailureClosed          = "closed"
+	FailureCanceled        = "canceled"
+	FailureTimeout         = "timeout"
+	FailureBinaryNotFound  = "binary_not_found"
+	FailureIncompatible    = "incompatible_binary"
+	FailureMalformedResult = "malformed_result"
+	FailureNoResult        = "no_result"
+	FailureSymmetricNAT    = "symmetric_nat"
+	FailurePeerAborted     = "peer_aborted"
+	FailureNatty           = "natty"
+	FailureOther           = "other"
+)
+
+// failureReason classifies err for MetricsHook.TraversalFailed.
+func failureReason(err error) string {
+	var timeoutErr *TimeoutError
+	var traversalErr *TraversalError
+	switch {
+	case errors.Is(err, ErrClosed):
+		return FailureClosed
+	case errors.As(err, &timeoutErr):
+		return FailureTimeout
+	case errors.Is(err, context.Canceled):
+		return FailureCanceled
+	case errors.Is(err, ErrBinaryNotFound):
+		return FailureBinaryNotFound
+	case errors.Is(err, ErrIncompatibleBinary):
+		return FailureIncompatible
+	case errors.Is(err, ErrMalformedFiveTuple):
+		return FailureMalformedResult
+	case errors.Is(err, ErrNoResult):
+		return FailureNoResult
+	case errors.Is(err, ErrSymmetricNAT):
+		return FailureSymmetricNAT
+	case errors.Is(err, ErrPeerAborted):
+		return FailurePeerAborted
+	case errors.As(err, &traversalErr):
+		return FailureNatty
+	default:
+		return FailureOther
+	}
+}
+
+// metrics calls fn with our MetricsHook, if one was configured. A panicking
+// hook is logged rather than being allowed to take down the Traversal.
+func (t *Traversal) metrics(fn func(hook MetricsHook)) {
+	if t.metricsHook == nil {
+		return
+	}
+	err := callSafely("metrics hook", func() {
+		fn(t.metricsHook)
+	})
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package natty
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingHook struct {
+	events []string
+	mutex  sync.Mutex
+}
+
+func (h *recordingHook) record(event string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHook) TraversalStarted()                  { h.record("started") }
+func (h *recordingHook) TraversalSucceeded(d time.Duration) { h.record("succeeded") }
+func (h *recordingHook) TraversalFailed(reason string)      { h.record("failed: " + reason) }
+func (h *recordingHook) CandidateSent()                     { h.record("candidate") }
+
+func (h *recordingHook) Events() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func TestMetricsHook(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+echo '{"type":"offer","sdp":"v=0"}'`
+	hook := &recordingHook{}
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithMetricsHook(hook))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err)
+	assert.Equal(t, []string{"started", "candidate", "failed: no_result"}, hook.Events())
+}
+
+func TestFailureReason(t *testing.T) {
+	assert.Equal(t, FailureClosed, failureReason(ErrClosed))
+	assert.Equal(t, FailureTimeout, failureReason(&TimeoutError{}))
+	assert.Equal(t, FailureBinaryNotFound, failureReason(fmt.Errorf("%w: missing", ErrBinaryNotFound)))
+	assert.Equal(t, FailureNatty, failureReason(&TraversalError{Message: "symmetric NAT"}))
+	assert.Equal(t, FailureOther, failureReason(fmt.Errorf("something else")))
+}
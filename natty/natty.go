@@ -7,13 +7,20 @@ package natty
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
 	"os/exec"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/byteexec"
@@ -26,33 +33,107 @@ const (
 	TCP = Protocol("tcp")
 )
 
+const (
+	// maxMessageSize is the most that we accumulate while waiting for a JSON
+	// message from natty to be complete.
+	maxMessageSize = 1024 * 1024
+
+	// maxStderrTail is how much of natty's most recent stderr output we keep
+	// around for inclusion in errors.
+	maxStderrTail = 4096
+
+	// stdinBufferSize is how much we buffer for natty's stdin when using
+	// WithBufferedStdin.
+	stdinBufferSize = 4096
+
+	// defaultResultMarker is the type of the messages with which natty reports
+	// a FiveTuple.
+	defaultResultMarker = "5-tuple"
+
+	// defaultShutdownGrace is how long natty gets to exit after being asked to
+	// terminate before we kill it.
+	defaultShutdownGrace = 2 * time.Second
+)
+
 var (
 	log = golog.LoggerFor("natty")
 
 	reallyHighTimeout = 100000 * time.Hour
 
-	nattybe *byteexec.Exec
+	nattybe      *byteexec.Exec
+	nattybeErr   error      // error encountered while setting up nattybe, if any
+	nattybeMutex sync.Mutex // makes sure that nattybe is only set up once, until Cleanup() removes it
 )
 
-func init() {
+// embeddedExec returns the byteexec.Exec for the embedded natty binary. The
+// binary is written to disk by whichever call comes first, and all subsequent
+// calls, including concurrent ones, share the result (until Cleanup()).
+func embeddedExec() (*byteexec.Exec, error) {
+	nattybeMutex.Lock()
+	defer nattybeMutex.Unlock()
+	if nattybe != nil || nattybeErr != nil {
+		return nattybe, nattybeErr
+	}
+
 	nattyBytes, err := bin.Asset("natty")
 	if err != nil {
-		panic(fmt.Errorf("Unable to read natty bytes: %s", err))
+		nattybeErr = fmt.Errorf("%w: unable to read natty bytes: %v", ErrBinaryNotFound, err)
+		return nil, nattybeErr
 	}
 
 	nattybe, err = byteexec.New(nattyBytes, "natty")
 	if err != nil {
-		panic(fmt.Errorf("Unable to construct byteexec for natty: %s", err))
+		nattybeErr = fmt.Errorf("Unable to construct byteexec for natty: %s", err)
+	}
+	return nattybe, nattybeErr
+}
+
+// WarmUp extracts the embedded natty binary to disk right away, rather than
+// when the first Traversal needs it, so that latency-sensitive services don't
+// pay for writing the binary on their first traversal. Call it at process
+// startup. The binary is only extracted once per process, until removed with
+// Cleanup, so WarmUp can be called any number of times, including concurrently
+// with itself and with running Traversals. Unlike Prepare, it doesn't check
+// the extracted binary.
+func WarmUp() error {
+	_, err := embeddedExec()
+	return err
+}
+
+// Prepare checks that the embedded natty binary was successfully extracted to
+// disk and is executable, so that callers can verify at startup (for example
+// in a health check) that traversal will be possible, well before any peer
+// shows up. The returned error names the path at which natty was expected.
+func Prepare() error {
+	be, err := embeddedExec()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(be.Filename)
+	if err != nil {
+		return fmt.Errorf("Unable to stat natty binary at %s: %s", be.Filename, err)
 	}
+	if info.IsDir() {
+		return fmt.Errorf("natty binary at %s is a directory", be.Filename)
+	}
+	if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		return fmt.Errorf("natty binary at %s is not executable", be.Filename)
+	}
+	return nil
 }
 
 type Protocol string
 
+// Valid reports whether p is one of the known Protocols.
+func (p Protocol) Valid() bool {
+	return p == UDP || p == TCP
+}
+
 // A FiveTuple is the result of a successful NAT traversal.
 type FiveTuple struct {
-	Proto  Protocol
-	Local  string
-	Remote string
+	Proto  Protocol `json:"proto"`
+	Local  string   `json:"local"`
+	Remote string   `json:"remote"`
 }
 
 // UDPAddrs returns a pair of UDPAddrs representing the Local and Remote
@@ -75,31 +156,139 @@ func (ft *FiveTuple) UDPAddrs() (local *net.UDPAddr, remote *net.UDPAddr, err er
 	return
 }
 
+// NatTraverser is the interface implemented by Traversal. Code that depends on
+// NatTraverser rather than *Traversal can substitute a fake (see the nattytest
+// package) in tests.
+type NatTraverser interface {
+	// MsgIn passes a message from the peer.
+	MsgIn(msg string) error
+
+	// NextMsgOut gets the next message to pass to the peer.
+	NextMsgOut() (msg string, done bool)
+
+	// FiveTuple blocks until the result of the traversal is available.
+	FiveTuple() (*FiveTuple, error)
+
+	// Close terminates the traversal.
+	Close() error
+}
+
 // Traversal represents a single NAT traversal using natty, whose result is
 // available via the methods FiveTuple() and FiveTupleTimeout().
 //
 // Consumers should make sure to call Close() after finishing with this Natty
 // in order to make sure the underlying natty process and associated resources
 // are closed.
+//
+// A Traversal is single-use: once it has produced a FiveTuple or an error, it
+// can't be restarted. To traverse again, for example to connect to another
+// peer, start a new Traversal with Offer() or Answer(). Doing so is cheap, as
+// the embedded natty binary is only extracted to disk once per process, when
+// first needed, and is shared by all Traversals.
 type Traversal struct {
-	timeout            time.Duration   // how long to wait before terminating traversal
-	traceOut           io.Writer       // target for output from natty's stderr
-	cmd                *exec.Cmd       // the natty command
-	stdin              io.WriteCloser  // pipe to natty's stdin
-	stdout             io.ReadCloser   // pipe from natty's stdout
-	stdoutbuf          *bufio.Reader   // buffered stdout
-	stderr             io.ReadCloser   // pipe from natty's stderr
-	msgInCh            chan string     // channel for messages inbound to this Natty
-	msgOutCh           chan string     // channel for messages outbound from this Natty
-	peerGotFiveTupleCh chan bool       // channel to signal once we know that our peer received their own FiveTuple
-	fiveTupleCh        chan *FiveTuple // intermediary channel for the FiveTuple emitted by the natty command
-	errCh              chan error      // intermediary channel for any error encountered while running natty
-	fiveTupleOutCh     chan *FiveTuple // channel for FiveTuple output
-	errOutCh           chan error      // channel for error output
-	fiveTupleOut       *FiveTuple      // the output FiveTuple
-	errOut             error           // the output error
-	outMutex           sync.Mutex      // mutex for synchronizing access to output variables
-	iowg               sync.WaitGroup  // WaitGroup to wait for stdout and stderr processing to finish
+	role               Role                   // whether we're offering or answering
+	opts               []Option               // the Options with which the Traversal was configured
+	ctx                context.Context        // context controlling the lifetime of the traversal
+	idleTimeout        time.Duration          // how long natty may go without producing output
+	timeout            time.Duration          // how long to wait before terminating traversal
+	traceOut           io.Writer              // target for output from natty's stderr
+	debug              bool                   // whether to tell natty to log debug output
+	logger             *slog.Logger           // logger for structured events, if any
+	messageLog         io.Writer              // target for a record of each message exchanged with the peer, if any
+	messageLogContent  bool                   // whether to include the content of messages in messageLog
+	send               func(msg []byte) error // callback for sending messages to the peer, if any
+	sendQueueSize      int                    // how many messages may be queued for send, or 0 to call send directly
+	sendQueue          chan string            // queue of messages waiting to be passed to send, if any
+	receiveRate        int                    // how many messages per second MsgIn accepts, or 0 for no limit
+	receiveTokens      float64                // how many more messages MsgIn can accept right now
+	receiveRefilled    time.Time              // when receiveTokens was last refilled
+	receiveMutex       sync.Mutex             // mutex for synchronizing access to receiveTokens and receiveRefilled
+	offerCallback      func(sdp []byte)       // callback for SDP offers and answers, if any
+	metricsHook        MetricsHook            // hook for recording metrics, if any
+	candidateCallback  func(Candidate)        // callback for ICE candidates gathered by natty, if any
+	endOfCandidates    func()                 // callback for natty finishing gathering candidates, if any
+	abortDetector      func(msg []byte) bool  // recognizes messages from the peer that abort the traversal, if any
+	progressCallback   func(Phase)            // callback for reporting progress, if any
+	resultCallback     ResultCallback         // callback for the outcome of the traversal, if any
+	rawStdoutCallback  func(line string)      // callback for each raw line of natty's stdout, if any
+	binaryPath         string                 // path to a natty binary to use instead of the embedded one
+	assetFunc          AssetFunc              // loader for the natty binary to use instead of the embedded one
+	extractDir         string                 // directory to extract the natty binary to, if not the default
+	minBinaryVersion   string                 // the oldest version of the natty binary that we accept
+	stunServers        []string               // STUN servers for natty to use
+	stunFallback       bool                   // whether to use one STUN server per attempt, in order
+	stunServerIndex    int                    // index of the STUN server to use for the current attempt, with stunFallback
+	turnServer         *turnServer            // TURN server for natty to use
+	turnCredentials    TURNCredentialProvider // provider of credentials for turnServer, if any
+	forceRelay         bool                   // whether to tell natty to gather only relay candidates
+	expectedRemote     string                 // the IP or CIDR range that the remote address must be in, if any
+	cleanupOnExit      bool                   // whether to clean up extracted natty binaries when the process is told to exit
+	resultMarker       string                 // the type of the messages that carry a FiveTuple, if not the default
+	fiveTupleDecoder   FiveTupleDecoder       // decoder for 5-tuple messages, if not json.Unmarshal
+	localInterface     string                 // IP of the local interface for natty to bind to
+	resourceLimits     *ResourceLimits        // resource limits for the natty process, if any
+	env                map[string]string      // environment variables to set for natty
+	extraArgs          []string               // additional arguments to pass to natty
+	framing            Framing                // how messages are delimited on natty's stdin and stdout
+	retryAttempts      int                    // how many times to attempt traversal
+	retryBackoff       time.Duration          // how long to wait before the first retry
+	runner             commandRunner          // creates the natty command
+	cmd                command                // the natty command
+	stdin              io.WriteCloser         // pipe to natty's stdin
+	stdinWriter        *frameWriter           // buffer for messages to natty's stdin, if buffering them was requested
+	stdinFlushInterval time.Duration          // how often to flush stdinWriter, or 0 not to buffer stdin
+	stdout             io.ReadCloser          // pipe from natty's stdout
+	stdoutbuf          *bufio.Reader          // buffered stdout
+	rawStdout          *lineWriter            // passes each line of stdout to rawStdoutCallback, if it's set
+	stderr             io.ReadCloser          // pipe from natty's stderr
+	debugBuffer        *tailBuffer            // all of natty's stderr output, if buffering it was requested
+	timestampedDebug   bool                   // whether to timestamp each line of stderr written to traceOut
+	stderrTail         *tailBuffer            // the most recent output from natty's stderr
+	msgInCh            chan string            // channel for messages inbound to this Natty
+	msgOutCh           chan string            // channel for messages outbound from this Natty
+	peerGotFiveTupleCh chan bool              // channel to signal once we know that our peer received their own FiveTuple
+	fiveTupleCh        chan *FiveTuple        // intermediary channel for the FiveTuple emitted by the natty command
+	errCh              chan error             // intermediary channel for any error encountered while running natty
+	connectReadyCh     chan struct{}          // closed once both session descriptions have been exchanged
+	resultsCh          chan *FiveTuple        // delivers the FiveTuple once the traversal has succeeded, see Results()
+	errorsCh           chan error             // delivers errors encountered by background goroutines, see Errors()
+	localSDP           bool                   // whether natty has emitted its session description
+	remoteSDP          bool                   // whether we've received the peer's session description
+	localDescription   string                 // the first session description that natty emitted
+	localDescriptionCh chan struct{}          // closed once natty has emitted its session description
+	sdpMutex           sync.Mutex             // mutex for synchronizing access to localSDP, remoteSDP and localDescription
+	fiveTupleOut       *FiveTuple             // the output FiveTuple, set before finishedCh is closed
+	errOut             error                  // the output error, set before finishedCh is closed
+	iowg               sync.WaitGroup         // WaitGroup to wait for stdout and stderr processing to finish
+	incomingwg         sync.WaitGroup         // WaitGroup to wait for processing of incoming messages to finish
+	activityCh         chan struct{}          // signaled whenever natty produces output
+	stopCh             chan struct{}          // closed once the current attempt has finished, to stop background goroutines
+	maxProcessLifetime time.Duration          // how long each natty process may run, or 0 for no limit
+	watchdogCh         <-chan time.Time       // fires once the current natty process exceeds maxProcessLifetime, if set
+	closedCh           chan struct{}          // closed once Close() has been called
+	finishedCh         chan struct{}          // closed once the whole traversal has finished and its result is available
+	exitedCh           chan struct{}          // closed once the natty process has exited and been reaped
+	exitErr            error                  // the result of waiting for the natty process
+	shutdownGrace      time.Duration          // how long to wait for natty to terminate before killing it
+	exitCode           int                    // the exit status of the natty process, or -1 if it hasn't exited
+	closeOnce          sync.Once              // makes sure that we only close once
+	closed             bool                   // whether Close() has been called, so that the Traversal can't be started afterwards
+	closeErr           error                  // the result of closing
+	procMutex          sync.Mutex             // mutex for synchronizing starting and killing the natty process
+	candidates         []Candidate            // the ICE candidates that natty has gathered
+	remoteCandidates   []Candidate            // the ICE candidates received from the peer
+	foundations        foundations            // the foundations of the selected candidate pair, if natty reported them
+	fiveTupleSeen      bool                   // whether the current natty has emitted a FiveTuple, after which it can't restart
+	candidatesMutex    sync.Mutex             // mutex for synchronizing access to candidates, foundations and fiveTupleSeen
+	stats              Stats                  // stats for this traversal
+	statsMutex         sync.Mutex             // mutex for synchronizing access to stats
+	conn               net.Conn               // the connection dialed by Connection(), if any
+	keepaliveInterval  time.Duration          // how often to send keepalives on conn, or 0 not to
+	connClosed         bool                   // whether conn has been closed by Close()
+	connMutex          sync.Mutex             // mutex for synchronizing access to conn
+	phase              Phase                  // the most recent Phase reached
+	phaseStarted       map[Phase]time.Time    // when each Phase was reached
+	phaseMutex         sync.Mutex             // mutex for synchronizing access to phase and phaseStarted
 }
 
 // Offer starts a Traversal as an Offerer, meaning that it will make an offer to
@@ -107,12 +296,23 @@ type Traversal struct {
 // Traversal. If timeout is hit, the traversal will stop and FiveTuple() will
 // return an error. A timeout of 0 means that the Traversal will never time out.
 func Offer(timeout time.Duration) *Traversal {
+	return OfferWithOptions(WithTimeout(timeout))
+}
+
+// OfferContext is like Offer, except that the lifetime of the Traversal is
+// controlled by ctx instead of a timeout. If ctx is cancelled or its deadline
+// passes before a FiveTuple is obtained, the natty process is killed and
+// FiveTuple() returns ctx.Err(), or a *TimeoutError if the deadline passed.
+func OfferContext(ctx context.Context) *Traversal {
+	return OfferWithOptions(WithContext(ctx))
+}
+
+// OfferWithOptions is like Offer, but configures the Traversal using the given
+// Options.
+func OfferWithOptions(opts ...Option) *Traversal {
 	log.Trace("Offering")
-	t := &Traversal{
-		timeout:  timeout,
-		traceOut: log.TraceOut(),
-	}
-	t.run([]string{"-offer"})
+	t := New(opts...)
+	t.Start(RoleOfferer)
 	return t
 }
 
@@ -121,144 +321,861 @@ func Offer(timeout time.Duration) *Traversal {
 // Traversal. If timeout is hit, the traversal will stop and FiveTuple() will
 // return an error. A timeout of 0 means that the Traversal will never time out.
 func Answer(timeout time.Duration) *Traversal {
+	return AnswerWithOptions(WithTimeout(timeout))
+}
+
+// AnswerContext is like Answer, except that the lifetime of the Traversal is
+// controlled by ctx instead of a timeout. If ctx is cancelled or its deadline
+// passes before a FiveTuple is obtained, the natty process is killed and
+// FiveTuple() returns ctx.Err(), or a *TimeoutError if the deadline passed.
+func AnswerContext(ctx context.Context) *Traversal {
+	return AnswerWithOptions(WithContext(ctx))
+}
+
+// AnswerWithOptions is like Answer, but configures the Traversal using the
+// given Options.
+func AnswerWithOptions(opts ...Option) *Traversal {
 	log.Trace("Answering")
+	t := New(opts...)
+	t.Start(RoleAnswerer)
+	return t
+}
+
+// OfferWithRetry is like Offer, but makes up to attempts attempts at
+// traversal, each of which times out after timeout. See WithRetry for details.
+func OfferWithRetry(timeout time.Duration, attempts int, backoff time.Duration) *Traversal {
+	return OfferWithOptions(WithTimeout(timeout), WithRetry(attempts, backoff))
+}
+
+// AnswerWithRetry is like Answer, but makes up to attempts attempts at
+// traversal, each of which times out after timeout. See WithRetry for details.
+func AnswerWithRetry(timeout time.Duration, attempts int, backoff time.Duration) *Traversal {
+	return AnswerWithOptions(WithTimeout(timeout), WithRetry(attempts, backoff))
+}
+
+// New creates a Traversal configured with the given Options without starting
+// it, so that launching natty can be separated from waiting for its result.
+// Call Start to launch natty, then observe the result with Done(),
+// WaitForResult or FiveTuple(), and tear it down with Stop(). Until it's
+// started, the Traversal behaves like one that was never started, for example
+// WaitForResult returns ErrNotStarted.
+func New(opts ...Option) *Traversal {
+	return newTraversal(opts)
+}
+
+func newTraversal(opts []Option) *Traversal {
 	t := &Traversal{
-		timeout:  timeout,
-		traceOut: log.TraceOut(),
+		ctx:           context.Background(),
+		traceOut:      log.TraceOut(),
+		runner:        execRunner,
+		exitCode:      -1,
+		shutdownGrace: defaultShutdownGrace,
+		opts:          opts,
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
-	t.run([]string{})
 	return t
 }
 
+// Start launches natty in the given Role and starts processing its output in
+// the background, returning immediately. natty starts gathering candidates
+// right away, but messages for the peer are held in Messages() until they're
+// read, so signaling with the peer can be set up after Start returns. Start
+// should be called before the Traversal is shared with other goroutines. It
+// returns ErrAlreadyStarted if the Traversal has already been started, and
+// ErrClosed if it has been closed. Problems running natty itself, like a
+// missing binary, are reported by FiveTuple() as usual.
+func (t *Traversal) Start(role Role) error {
+	var params []string
+	switch role {
+	case RoleOfferer:
+		params = []string{"-offer"}
+	case RoleAnswerer:
+		params = []string{}
+	default:
+		return fmt.Errorf("Unable to start Traversal in role %v", role)
+	}
+
+	t.procMutex.Lock()
+	if t.role != RoleUnknown {
+		t.procMutex.Unlock()
+		return ErrAlreadyStarted
+	}
+	if t.closed {
+		t.procMutex.Unlock()
+		return ErrClosed
+	}
+	t.role = role
+	t.msgInCh = make(chan string, 100)
+	t.msgOutCh = make(chan string, 100)
+	t.closedCh = make(chan struct{})
+	t.finishedCh = make(chan struct{})
+	t.connectReadyCh = make(chan struct{})
+	t.resultsCh = make(chan *FiveTuple, 1)
+	t.localDescriptionCh = make(chan struct{})
+	t.errorsCh = make(chan error, 100)
+	t.procMutex.Unlock()
+
+	if t.cleanupOnExit {
+		cleanupOnSignals()
+	}
+	t.run(params)
+	return nil
+}
+
+// Stop stops the Traversal, killing natty if it's still running. It's the
+// counterpart to Start and is equivalent to Close().
+func (t *Traversal) Stop() error {
+	return t.Close()
+}
+
+// Clone starts a new Traversal in the same Role as this one, configured with
+// the same Options followed by opts, for example a different WithSend for
+// another peer. This way, a Traversal can serve as a template for many others
+// without having to specify all of its Options again. The new Traversal has its
+// own natty process and state and is otherwise independent of this one, which
+// may even have finished already, though any callbacks or writers passed to
+// the original Options are shared. Clone returns nil if this Traversal wasn't
+// started with Offer() or Answer() or one of their variants.
+func (t *Traversal) Clone(opts ...Option) *Traversal {
+	all := append(append([]Option(nil), t.opts...), opts...)
+	switch t.role {
+	case RoleOfferer:
+		return OfferWithOptions(all...)
+	case RoleAnswerer:
+		return AnswerWithOptions(all...)
+	default:
+		return nil
+	}
+}
+
 // MsgIn is used to pass this Traversal a message from the peer t. This method
-// is buffered and will typically not block.
-func (t *Traversal) MsgIn(msg string) {
+// is buffered and will typically not block. It is safe to call MsgIn from
+// multiple goroutines. Once the Traversal has finished or been closed, MsgIn
+// returns ErrClosed instead of blocking. If the Traversal was never started,
+// MsgIn returns ErrNotStarted.
+//
+// Messages are passed to natty's stdin one per line, so each msg must be a
+// single line. A trailing newline, like the one on messages returned by
+// NextMsgOut(), is fine and is stripped, but a message with a newline anywhere
+// else would be split in two and misparsed by natty, so MsgIn rejects it with
+// ErrInvalidMessage instead. The Traversal remains usable after rejecting a
+// message. With FramingLengthPrefixed (see WithFraming), msg is passed to
+// natty exactly as given, including any newlines.
+func (t *Traversal) MsgIn(msg string) error {
+	return t.MsgInContext(context.Background(), msg)
+}
+
+// MsgInContext is like MsgIn, except that if the message can't be queued
+// before ctx is done, it gives up and returns ctx.Err(). The message is then
+// dropped, and the Traversal remains usable for subsequent messages.
+func (t *Traversal) MsgInContext(ctx context.Context, msg string) error {
 	log.Tracef("Got message: %s", msg)
-	t.msgInCh <- msg
+	if t.framing == FramingNewline {
+		msg = strings.TrimRight(msg, "\r\n")
+		if strings.ContainsAny(msg, "\r\n") {
+			log.Tracef("Rejecting message with embedded newline: %q", msg)
+			return ErrInvalidMessage
+		}
+	}
+	if t.msgInCh == nil {
+		return ErrNotStarted
+	}
+	select {
+	case <-t.finishedCh:
+		return ErrClosed
+	case <-t.closedCh:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if !t.allowReceive() {
+		log.Tracef("Rejecting message over rate limit: %s", msg)
+		return ErrRateLimited
+	}
+
+	select {
+	case t.msgInCh <- msg:
+		return nil
+	case <-t.finishedCh:
+		return ErrClosed
+	case <-t.closedCh:
+		return ErrClosed
+	case <-ctx.Done():
+		log.Tracef("Context done before message could be queued, dropping: %s", msg)
+		return ctx.Err()
+	}
+}
+
+// restartMsg is the command telling natty to perform an ICE restart.
+const restartMsg = `{"type":"restart"}`
+
+// Restart asks natty to perform an ICE restart, re-gathering candidates without
+// tearing down the session, for example because the local network changed
+// while traversal was in progress. Fresh candidates are sent to the peer as
+// usual and the resulting FiveTuple is delivered by FiveTuple(). This requires
+// a version of natty that accepts the restart command on stdin, which it
+// advertises by listing --restart in its usage. The bundled natty doesn't, in
+// which case Restart returns an error without sending anything. Since a
+// Traversal stops natty once it has a result, Restart returns ErrClosed once
+// natty has emitted a FiveTuple; to reconnect after that, start a new
+// Traversal. If the Traversal was never started, Restart returns
+// ErrNotStarted.
+func (t *Traversal) Restart() error {
+	if t.finishedCh == nil {
+		return ErrNotStarted
+	}
+	err := t.requireFlag("restart")
+	if err != nil {
+		return fmt.Errorf("Unable to restart: %s", err)
+	}
+	t.candidatesMutex.Lock()
+	fiveTupleSeen := t.fiveTupleSeen
+	t.candidatesMutex.Unlock()
+	if fiveTupleSeen {
+		return ErrClosed
+	}
+	log.Trace("Requesting ICE restart")
+	return t.MsgIn(restartMsg)
 }
 
 // NextMsgOut gets the next message to pass to the peer.  If done is true, there
 // are no more messages to be read, and the currently returned message should be
-// ignored.
+// ignored. If the Traversal was never started, there are no messages and done
+// is true.
 func (t *Traversal) NextMsgOut() (msg string, done bool) {
+	if t.msgOutCh == nil {
+		log.Trace("Traversal not started, no out messages")
+		return "", true
+	}
 	m, ok := <-t.msgOutCh
 	log.Tracef("Returning out message: %s", m)
 	return m, !ok
 }
 
-// FiveTuple gets the FiveTuple from the Traversal, blocking until such is
-// available or the configured timeout is hit.
-func (t *Traversal) FiveTuple() (*FiveTuple, error) {
-	log.Trace("Getting FiveTuple")
-	t.outMutex.Lock()
-	defer t.outMutex.Unlock()
+// Messages returns a channel of the messages to pass to the peer, as an
+// alternative to calling NextMsgOut(). The channel is closed once natty stops
+// producing output, so it's safe to range over it. Consumers should use either
+// Messages() or NextMsgOut(), not both. If the Traversal was configured
+// WithSend, messages are delivered to that callback instead.
+func (t *Traversal) Messages() <-chan string {
+	return t.msgOutCh
+}
 
-	if t.fiveTupleOut != nil || t.errOut != nil {
-		log.Trace("Returning existing result")
-	} else {
-		log.Trace("We don't have a result yet, wait for one")
+// ConnectReady returns a channel that is closed once natty has emitted its
+// own session description and received the peer's, at which point it has
+// gathered its candidates and is about to start connecting. Peers can use this
+// to synchronize, for example to coordinate a TCP simultaneous open via the
+// signaling channel. The channel is closed at most once per Traversal, even if
+// traversal is retried.
+func (t *Traversal) ConnectReady() <-chan struct{} {
+	return t.connectReadyCh
+}
+
+// LocalDescription waits for natty to emit its session description and
+// returns it, for signaling flows in which the description has to be published
+// before the peer joins, like store-and-forward signaling through a server.
+// Since natty starts gathering as soon as the Traversal starts, this just
+// waits for gathering to complete. The description is the message as natty
+// emitted it (the first one, if traversal is retried) minus the trailing
+// newline, and is still passed to the peer as
+// usual as well. If natty trickles candidates, they're not included and arrive
+// separately. If the traversal finishes before natty emits a description,
+// LocalDescription returns the traversal's error, or ErrNoResult if it
+// succeeded without one. If ctx is done first, it returns ctx.Err(). If the
+// Traversal was never started, it returns ErrNotStarted.
+func (t *Traversal) LocalDescription(ctx context.Context) ([]byte, error) {
+	if t.localDescriptionCh == nil {
+		return nil, ErrNotStarted
+	}
+	select {
+	case <-t.localDescriptionCh:
+	case <-t.finishedCh:
 		select {
-		case ft := <-t.fiveTupleOutCh:
-			log.Tracef("FiveTuple is: %s", ft)
-			t.fiveTupleOut = ft
-		case err := <-t.errOutCh:
-			log.Tracef("Error is: %s", err)
-			t.errOut = err
+		case <-t.localDescriptionCh:
+		default:
+			if t.errOut != nil {
+				return nil, t.errOut
+			}
+			return nil, ErrNoResult
 		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	t.sdpMutex.Lock()
+	defer t.sdpMutex.Unlock()
+	return []byte(t.localDescription), nil
+}
+
+// gotLocalDescription keeps the first session description that natty emitted
+// for LocalDescription.
+func (t *Traversal) gotLocalDescription(msg string) {
+	t.sdpMutex.Lock()
+	defer t.sdpMutex.Unlock()
+	select {
+	case <-t.localDescriptionCh:
+		// Already got one
+	default:
+		t.localDescription = strings.TrimRight(msg, "\r\n")
+		close(t.localDescriptionCh)
+	}
+}
+
+// gotSessionDescription records that a session description was emitted by
+// natty (local) or received from the peer, closing connectReadyCh once we've
+// seen both.
+func (t *Traversal) gotSessionDescription(local bool) {
+	t.sdpMutex.Lock()
+	if t.localSDP && t.remoteSDP {
+		t.sdpMutex.Unlock()
+		return
+	}
+	if local {
+		t.localSDP = true
+	} else {
+		t.remoteSDP = true
+	}
+	ready := t.localSDP && t.remoteSDP
+	if ready {
+		log.Trace("Session descriptions exchanged, ready to connect")
+		close(t.connectReadyCh)
+	}
+	t.sdpMutex.Unlock()
+
+	if ready {
+		t.progress(PhaseConnecting)
 	}
+}
 
+// FiveTuple gets the FiveTuple from the Traversal, blocking until such is
+// available or the configured timeout is hit. If the Traversal was never
+// started, FiveTuple returns ErrNotStarted.
+func (t *Traversal) FiveTuple() (*FiveTuple, error) {
+	log.Trace("Getting FiveTuple")
+	if t.finishedCh == nil {
+		return nil, ErrNotStarted
+	}
+	<-t.finishedCh
 	log.Tracef("FiveTuple returns %s: %s", t.fiveTupleOut, t.errOut)
 	return t.fiveTupleOut, t.errOut
 }
 
-// Close closes this Traversal, terminating any outstanding natty process by
-// sending SIGKILL. Close blocks until the natty process has terminated, at
-// which point any ports that it bound should be available for use.
+// WaitForResult is like FiveTuple(), but gives up waiting after timeout, in
+// which case it returns a *TimeoutError. Giving up doesn't stop the
+// traversal, so WaitForResult or FiveTuple() can be called again later. A
+// timeout of 0 means wait indefinitely. If the Traversal was never started,
+// WaitForResult returns ErrNotStarted.
+func (t *Traversal) WaitForResult(timeout time.Duration) (*FiveTuple, error) {
+	if t.finishedCh == nil {
+		return nil, ErrNotStarted
+	}
+	if timeout == 0 {
+		timeout = reallyHighTimeout
+	}
+	select {
+	case <-t.finishedCh:
+		return t.fiveTupleOut, t.errOut
+	case <-time.After(timeout):
+		log.Tracef("Gave up waiting for result after %v", timeout)
+		return nil, &TimeoutError{Elapsed: timeout}
+	}
+}
+
+// FiveTupleAsync is like FiveTuple(), but instead of blocking it returns
+// channels on which the result is delivered once available, for use in select
+// loops. Exactly one of the channels receives a value, after which both are
+// closed.
+//
+// When racing several Traversals, for example to different relays, the losers
+// can be cancelled individually by calling their Close() or cancelling the
+// context they were started with (see OfferContext). This kills only that
+// Traversal's natty process and stops its goroutines, leaving the others
+// running, and the cancelled Traversal's channels receive ErrClosed or the
+// context's error respectively.
+func (t *Traversal) FiveTupleAsync() (<-chan *FiveTuple, <-chan error) {
+	fiveTupleCh := make(chan *FiveTuple, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(fiveTupleCh)
+		defer close(errCh)
+		ft, err := t.FiveTuple()
+		if err != nil {
+			errCh <- err
+		} else {
+			fiveTupleCh <- ft
+		}
+	}()
+	return fiveTupleCh, errCh
+}
+
+// Done returns a channel that's closed once the traversal has finished,
+// whether it succeeded or failed, for use in select loops. Once it's closed,
+// the result is available without blocking from FiveTuple(), or Err() for just
+// the error. If the Traversal was never started, Done returns nil, which
+// blocks forever.
+func (t *Traversal) Done() <-chan struct{} {
+	return t.finishedCh
+}
+
+// Results returns a channel that delivers the FiveTuple once the traversal has
+// succeeded, for integrating the result into select loops after calling
+// Start. It's the lower-level counterpart to WaitForResult. The channel is
+// closed once the traversal has finished, without delivering anything if it
+// failed, in which case Err() tells why. Since the FiveTuple is delivered only
+// once, there should be only one consumer of Results(). Other code can still
+// get the FiveTuple from FiveTuple(). If the Traversal was never started,
+// Results returns nil, which blocks forever.
+func (t *Traversal) Results() <-chan *FiveTuple {
+	return t.resultsCh
+}
+
+// Errors returns a channel that delivers the errors encountered by the
+// Traversal's background goroutines, like failures to read natty's output, to
+// forward messages to natty or to send messages to the peer (see WithSend),
+// as they happen. Some of these end the current attempt and may become the
+// Traversal's overall error, while others are only noticed after the attempt
+// has ended and would otherwise go unseen. The overall outcome is still
+// reported by FiveTuple() and Err(). Errors are dropped if nobody reads them
+// and more than 100 pile up. The channel is never closed; use Done() to find
+// out when the traversal has finished. If the Traversal was never started,
+// Errors returns nil, which blocks forever.
+func (t *Traversal) Errors() <-chan error {
+	return t.errorsCh
+}
+
+// Err returns the error with which the traversal failed, or nil if it
+// succeeded or hasn't finished yet (see Done()).
+func (t *Traversal) Err() error {
+	select {
+	case <-t.finishedCh:
+		return t.errOut
+	default:
+		return nil
+	}
+}
+
+// LastError returns the most recent output (up to 4KB) that natty wrote to
+// stderr, which is useful for finding out why a traversal failed even if no
+// debug output was configured. If natty has been run more than once (see
+// WithRetry), this is the output of the latest attempt.
+func (t *Traversal) LastError() string {
+	t.procMutex.Lock()
+	stderrTail := t.stderrTail
+	t.procMutex.Unlock()
+	if stderrTail == nil {
+		return ""
+	}
+	return stderrTail.String()
+}
+
+// PID returns the process ID of the running natty process, or -1 if natty
+// hasn't started yet, has already exited or has no process of its own because
+// it's simulated (see WithEcho).
+func (t *Traversal) PID() int {
+	t.procMutex.Lock()
+	defer t.procMutex.Unlock()
+	if t.cmd == nil {
+		return -1
+	}
+	select {
+	case <-t.exitedCh:
+		return -1
+	default:
+		// Never hand out 0, which would signal our whole process group
+		if pid := t.cmd.Pid(); pid > 0 {
+			return pid
+		}
+		return -1
+	}
+}
+
+// DebugOutput returns everything that natty has written to stderr so far,
+// across all attempts. This requires the WithBufferedDebug Option, otherwise
+// DebugOutput always returns the empty string.
+func (t *Traversal) DebugOutput() string {
+	if t.debugBuffer == nil {
+		return ""
+	}
+	return t.debugBuffer.String()
+}
+
+// ExitCode returns the exit status of the natty process once it has exited, or
+// -1 if it hasn't exited yet or was killed by a signal.
+func (t *Traversal) ExitCode() int {
+	t.procMutex.Lock()
+	defer t.procMutex.Unlock()
+	return t.exitCode
+}
+
+// Close closes this Traversal, terminating any outstanding natty process. natty
+// is first sent SIGTERM so that it can clean up, for example by releasing TURN
+// allocations, and is sent SIGKILL if it's still running after the grace
+// period configured with WithShutdownGrace. Close blocks until the natty process has terminated, at
+// which point any ports that it bound should be available for use. Any
+// goroutine blocked in FiveTuple() is released with ErrClosed.
+//
+// Close also closes the connection returned by Connection(), if any.
+//
+// Close is idempotent. Calling it more than once returns the result of the
+// first call, and calling it before natty has started is a no-op.
 func (t *Traversal) Close() error {
-	if t.cmd == nil || t.cmd.Process == nil {
+	t.closeOnce.Do(func() {
+		t.closeErr = t.doClose()
+	})
+	return t.closeErr
+}
+
+func (t *Traversal) doClose() error {
+	t.procMutex.Lock()
+	t.closed = true
+	if t.closedCh != nil {
+		close(t.closedCh)
+	}
+	t.procMutex.Unlock()
+	t.closeConnection()
+	return t.stop()
+}
+
+// stop terminates the natty process for the current attempt, if it was
+// started, and waits for it to die. natty first gets a chance to exit cleanly
+// within shutdownGrace before it is killed.
+func (t *Traversal) stop() error {
+	t.procMutex.Lock()
+	cmd := t.cmd
+	exitedCh := t.exitedCh
+	t.procMutex.Unlock()
+
+	if cmd == nil || cmd.Pid() < 0 {
 		return nil
-	} else {
-		log.Trace("Killing natty process")
-		err := t.cmd.Process.Kill()
+	}
+
+	if t.shutdownGrace > 0 {
+		log.Trace("Terminating natty process")
+		err := cmd.Terminate()
 		if err != nil {
-			return fmt.Errorf("Unable to kill natty process: %s", err)
+			log.Tracef("Unable to terminate natty process: %s", err)
+		}
+		select {
+		case <-exitedCh:
+			log.Trace("natty process terminated")
+			return t.exitErr
+		case <-time.After(t.shutdownGrace):
+			log.Tracef("natty process still running after %v", t.shutdownGrace)
+		}
+	}
+
+	log.Trace("Killing natty process")
+	err := cmd.Kill()
+	if err != nil {
+		log.Tracef("Unable to kill natty process, waiting for it anyway: %s", err)
+	}
+	log.Trace("Waiting for natty process to die")
+	<-exitedCh
+	log.Trace("natty process is dead")
+	return t.exitErr
+}
+
+// waitForExit waits for the natty process to exit on its own or by being
+// killed, reaps it and records the result.
+func (t *Traversal) waitForExit() {
+	log.Trace("Waiting for reading from pipes to finish")
+	// Note - exec.Cmd requires us to finish reading from the pipes before
+	// calling Wait.
+	t.iowg.Wait()
+	t.exitErr = t.cmd.Wait()
+	log.Tracef("natty process exited: %v", t.exitErr)
+	t.procMutex.Lock()
+	t.exitCode = t.cmd.ExitCode()
+	t.procMutex.Unlock()
+	close(t.exitedCh)
+}
+
+// closePipes closes whichever of our pipes to natty have been opened. This is
+// only necessary if natty was never started, otherwise cmd.Wait() takes care of
+// it. See initCommand.
+func (t *Traversal) closePipes() {
+	for _, pipe := range []io.Closer{t.stdin, t.stdout, t.stderr} {
+		if pipe != nil {
+			pipe.Close()
 		}
-		log.Trace("Waiting for reading from pipes to finish")
-		t.iowg.Wait()
-		log.Trace("Waiting for natty process to die")
-		err = t.cmd.Wait()
-		log.Trace("natty process is dead")
-		return err
 	}
 }
 
 // run runs the natty command to obtain a FiveTuple. The actual running of
 // natty happens on a goroutine so that run itself doesn't block.
 func (t *Traversal) run(params []string) {
-	t.msgInCh = make(chan string, 100)
-	t.msgOutCh = make(chan string, 100)
-
-	// Note - these channels are buffered in order to prevent deadlocks
-	// The bufferDepth just needs to be at least as large as the total number of
-	// goroutines created during a single traversal (which is about 4).
-	bufferDepth := 10
-	t.peerGotFiveTupleCh = make(chan bool, bufferDepth)
-	t.fiveTupleCh = make(chan *FiveTuple, bufferDepth)
-	t.errCh = make(chan error, bufferDepth)
-	t.fiveTupleOutCh = make(chan *FiveTuple, bufferDepth)
-	t.errOutCh = make(chan error, bufferDepth)
-
-	err := t.initCommand(params)
+	t.updateStats(func(stats *Stats) {
+		stats.StartTime = time.Now()
+	})
+	t.logEvent(slog.LevelInfo, "Traversal started", "role", t.role, "params", params)
+	t.metrics(func(hook MetricsHook) {
+		hook.TraversalStarted()
+	})
 
 	go func() {
-		if err != nil {
-			t.errOutCh <- err
-			return
-		}
+		ft, err := t.runAttempts(params)
+		t.updateStats(func(stats *Stats) {
+			stats.CompletedTime = time.Now()
+		})
 
-		ft, err := t.doRun(params)
-		log.Trace("doRun is finished, inform client of the FiveTuple or error")
+		log.Trace("Traversal is finished, inform client of the FiveTuple or error")
 		if err != nil {
+			t.logEvent(slog.LevelInfo, "Traversal failed", "error", err, "stderr", t.LastError())
+			t.metrics(func(hook MetricsHook) {
+				hook.TraversalFailed(failureReason(err))
+			})
+			t.progress(PhaseFailed)
 			log.Tracef("Returning error: %s", err)
-			t.errOutCh <- err
-			log.Tracef("Returned error: %s", err)
 		} else {
+			t.logEvent(slog.LevelInfo, "Traversal succeeded", "proto", ft.Proto, "local", ft.Local, "remote", ft.Remote)
+			t.metrics(func(hook MetricsHook) {
+				hook.TraversalSucceeded(t.Stats().Duration)
+			})
+			t.progress(PhaseSucceeded)
 			log.Tracef("Returning FiveTuple: %s", ft)
-			t.fiveTupleOutCh <- ft
+		}
+		if ft != nil {
+			relayed := t.relayed(ft)
+			t.updateStats(func(stats *Stats) {
+				stats.Relayed = relayed
+			})
+		}
+		t.fiveTupleOut = ft
+		t.errOut = err
+
+		// Every attempt has finished processing stdout by now, so nothing else
+		// will be sent on msgOutCh.
+		close(t.msgOutCh)
+		close(t.finishedCh)
+		if ft != nil {
+			t.resultsCh <- ft
+		}
+		close(t.resultsCh)
+
+		if t.resultCallback != nil {
+			cbErr := callSafely("result callback", func() { t.resultCallback(ft, err) })
+			if cbErr != nil {
+				log.Errorf("%s", cbErr)
+			}
+		}
+
+		if err == nil && t.keepaliveInterval > 0 {
+			t.keepAlive()
 		}
 	}()
 }
 
-// doRun does the running, including resource cleanup.  doRun blocks until
-// Close() has finished, meaning that natty is no longer running and whatever
-// port it returned in the FiveTuple can now be used for other things.
-func (t *Traversal) doRun(params []string) (*FiveTuple, error) {
-	defer t.Close()
+// runAttempts runs natty until it produces a FiveTuple, retrying failed
+// attempts as configured with WithRetry.
+func (t *Traversal) runAttempts(params []string) (*FiveTuple, error) {
+	attempts := t.retryAttempts
+	if t.stunFallback && len(t.stunServers) > attempts {
+		attempts = len(t.stunServers)
+	}
+	backoff := t.retryBackoff
+	for attempt := 1; ; attempt++ {
+		t.updateStats(func(stats *Stats) {
+			stats.Attempts = attempt
+		})
+		if t.stunFallback && len(t.stunServers) > 0 {
+			t.stunServerIndex = (attempt - 1) % len(t.stunServers)
+			t.updateStats(func(stats *Stats) {
+				stats.STUNServer = t.stunServers[t.stunServerIndex]
+			})
+		}
+		ft, retriable, err := t.doRun(params)
+		if err == nil || !retriable || attempt >= attempts {
+			return ft, err
+		}
+
+		log.Tracef("Attempt %d failed, retrying in %v: %s", attempt, backoff, err)
+		t.logEvent(slog.LevelInfo, "Attempt failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-t.ctx.Done():
+			return nil, t.ctxErr()
+		case <-t.closedCh:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// doRun does a single run of natty, including resource cleanup. doRun blocks
+// until natty is no longer running, meaning that whatever port it returned in
+// the FiveTuple can now be used for other things. retriable indicates whether
+// the failure of this attempt means that another attempt might succeed.
+func (t *Traversal) doRun(params []string) (ft *FiveTuple, retriable bool, err error) {
+	params, err = t.commandParams(params)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.procMutex.Lock()
+	select {
+	case <-t.closedCh:
+		t.procMutex.Unlock()
+		return nil, false, ErrClosed
+	default:
+	}
+
+	// Note - these channels are buffered in order to prevent deadlocks
+	// The bufferDepth just needs to be at least as large as the total number of
+	// goroutines created during a single attempt (which is about 4).
+	bufferDepth := 10
+	t.peerGotFiveTupleCh = make(chan bool, bufferDepth)
+	t.fiveTupleCh = make(chan *FiveTuple, bufferDepth)
+	t.errCh = make(chan error, bufferDepth)
+	t.activityCh = make(chan struct{}, 1)
+	t.stopCh = make(chan struct{})
+	t.exitedCh = make(chan struct{})
+	t.cmd = nil
+	t.stdinWriter = nil
+	t.sendQueue = nil
+	t.candidatesMutex.Lock()
+	t.fiveTupleSeen = false
+	t.candidatesMutex.Unlock()
+	if t.send != nil && t.sendQueueSize > 0 {
+		t.sendQueue = make(chan string, t.sendQueueSize)
+	}
+
+	err = t.initCommand(params)
+	if err != nil {
+		t.procMutex.Unlock()
+		return nil, false, err
+	}
 
 	t.iowg.Add(2)
 	go t.processStdout()
 	go t.processStderr()
 
-	// Start the natty command
-	t.errCh <- t.cmd.Start()
+	err = t.cmd.Start()
+	if err != nil {
+		// There's no natty process to stop
+		t.cmd = nil
+		t.procMutex.Unlock()
+		// Start closes the pipes on failure, which releases the readers
+		t.iowg.Wait()
+		if errors.Is(err, errExecFormat) {
+			err = fmt.Errorf("%w: natty binary can't run on %s/%s: %v", ErrIncompatibleBinary, runtime.GOOS, runtime.GOARCH, err)
+		}
+		return nil, false, err
+	}
+	go t.waitForExit()
+	t.watchdogCh = nil
+	if t.maxProcessLifetime > 0 {
+		t.watchdogCh = time.After(t.maxProcessLifetime)
+	}
+	t.procMutex.Unlock()
+	t.progress(PhaseGathering)
 
+	// Note - deferred functions run in reverse order. stopCh is closed before
+	// stopping so that goroutines blocked on channels get out of the way of the
+	// pipes being drained.
+	defer t.incomingwg.Wait()
+	defer t.stop()
+	defer close(t.stopCh)
+
+	t.incomingwg.Add(1)
 	go t.processIncoming()
+	if t.stdinWriter != nil {
+		t.incomingwg.Add(1)
+		go t.flushStdin(t.stdinWriter, t.stopCh)
+	}
+	if t.sendQueue != nil {
+		go t.processSendQueue(t.sendQueue, t.stopCh, t.errCh)
+	}
 
-	return t.waitForFiveTuple()
+	ft, err = t.waitForFiveTuple()
+	retriable = !errors.Is(err, ErrClosed) && !errors.Is(err, ErrPeerAborted) &&
+		!errors.Is(err, ErrSymmetricNAT) && t.ctx.Err() == nil
+	return ft, retriable, err
 }
 
-// initCommand sets up the natty command
-func (t *Traversal) initCommand(params []string) (err error) {
-	if log.IsTraceEnabled() {
+// commandParams adds the flags for the configured Options to params,
+// validating the Options along the way. This may run natty to find out what
+// it supports, or call user callbacks like a TURNCredentialProvider, either of
+// which can take a while, so doRun calls it without holding procMutex to keep
+// Close(), PID() and friends responsive in the meantime.
+func (t *Traversal) commandParams(params []string) ([]string, error) {
+	if t.debug || log.IsTraceEnabled() {
 		log.Trace("Telling natty to log debug output")
 		params = append(params, "-debug")
 	}
 
-	t.cmd = nattybe.Command(params...)
+	serverParams, err := t.serverParams()
+	if err != nil {
+		return nil, err
+	}
+	params = append(params, serverParams...)
+
+	if t.localInterface != "" {
+		if net.ParseIP(t.localInterface) == nil {
+			return nil, fmt.Errorf("Invalid local interface IP %q", t.localInterface)
+		}
+		err = t.requireFlag("bind")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to bind to local interface %s: %s", t.localInterface, err)
+		}
+		params = append(params, "-bind", t.localInterface)
+	}
+	if t.expectedRemote != "" {
+		_, err = parseIPOrCIDR(t.expectedRemote)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.forceRelay {
+		if t.turnServer == nil {
+			return nil, fmt.Errorf("Unable to force relay without a TURN server")
+		}
+		err = t.requireFlag("relay")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to force relay: %s", err)
+		}
+		params = append(params, "-relay")
+	}
+	params = append(params, t.extraArgs...)
+
+	if t.minBinaryVersion != "" {
+		err = t.checkBinaryVersion()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
+// initCommand sets up the natty command. If it fails part way, it closes
+// whichever pipes it has already opened, since natty won't be started to take
+// care of them.
+func (t *Traversal) initCommand(params []string) (err error) {
+	// Don't leave the previous attempt's pipes around to be closed again
+	t.stdin, t.stdout, t.stderr = nil, nil, nil
+	defer func() {
+		if err != nil {
+			t.closePipes()
+			t.stdinWriter = nil
+			if t.cmd != nil {
+				discardCommand(t.cmd)
+			}
+		}
+	}()
+
+	t.cmd, err = t.runner(t, params)
+	if err != nil {
+		return err
+	}
 	t.stdin, err = t.cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
+	if t.stdinFlushInterval > 0 {
+		t.stdinWriter = newFrameWriter(t.stdin, stdinBufferSize)
+	}
 	t.stdout, err = t.cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -269,116 +1186,698 @@ func (t *Traversal) initCommand(params []string) (err error) {
 	}
 
 	t.stdoutbuf = bufio.NewReader(t.stdout)
+	t.rawStdout = nil
+	if t.rawStdoutCallback != nil {
+		t.rawStdout = &lineWriter{onLine: t.rawStdoutLine}
+		t.stdoutbuf = bufio.NewReader(io.TeeReader(t.stdout, t.rawStdout))
+	}
+	t.stderrTail = &tailBuffer{max: maxStderrTail}
 
 	return nil
 }
 
+// nattyCommand builds a command that runs whichever natty binary this
+// Traversal is configured to use with the given params.
+func (t *Traversal) nattyCommand(params ...string) (*exec.Cmd, error) {
+	path, err := t.binaryFile()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(path, params...), nil
+}
+
+// binaryFile returns the path of the natty binary that this Traversal is
+// configured to use, extracting it to disk first if necessary.
+func (t *Traversal) binaryFile() (string, error) {
+	if t.binaryPath != "" {
+		path, err := exec.LookPath(t.binaryPath)
+		if err != nil {
+			if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("%w: %v", ErrBinaryNotFound, err)
+			}
+			return "", fmt.Errorf("natty binary at %s is not executable: %s", t.binaryPath, err)
+		}
+		log.Tracef("Using natty binary at %s", path)
+		return path, nil
+	}
+	if t.assetFunc != nil || t.extractDir != "" {
+		assetFunc := t.assetFunc
+		if assetFunc == nil {
+			assetFunc = bin.Asset
+		}
+		be, err := assetExec(assetFunc, t.extractDir)
+		if err != nil {
+			return "", err
+		}
+		return be.Filename, nil
+	}
+	be, err := embeddedExec()
+	if err != nil {
+		return "", err
+	}
+	return be.Filename, nil
+}
+
+// recordCandidates records the local candidates found in msg, which natty sent
+// for the peer, and reports them to the metrics hook and candidate callback.
+func (t *Traversal) recordCandidates(msg string) error {
+	for _, candidate := range findCandidates(msg) {
+		t.candidatesMutex.Lock()
+		t.candidates = append(t.candidates, candidate)
+		t.candidatesMutex.Unlock()
+		t.metrics(func(hook MetricsHook) {
+			hook.CandidateSent()
+		})
+		if t.candidateCallback != nil {
+			err := callSafely("candidate callback", func() {
+				t.candidateCallback(candidate)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // processStdout reads the output from natty and sends it to the msgOutCh. If
 // it finds a FiveTuple, it records that.
 func (t *Traversal) processStdout() {
 	defer t.iowg.Done()
+	if t.rawStdout != nil {
+		defer t.rawStdout.Flush()
+	}
 
 	for {
 		// Read next message from natty
-		msg, err := t.stdoutbuf.ReadString('\n')
+		msg, err := t.readMessage()
 		if err != nil {
-			t.errCh <- err
+			t.sendErr(err)
 			return
 		}
+		select {
+		case t.activityCh <- struct{}{}:
+		default:
+			// Activity has already been signaled
+		}
+
+		if IsSessionDescription(msg) {
+			t.gotLocalDescription(msg)
+			t.gotSessionDescription(true)
+		}
+
+		if t.offerCallback != nil && IsSessionDescription(msg) {
+			// The session description may carry candidates, which need to be
+			// recorded even though it doesn't go out with the other messages.
+			err = t.recordCandidates(msg)
+			if err != nil {
+				t.sendErr(err)
+				return
+			}
+			log.Trace("Passing session description to offer callback")
+			err = callSafely("offer callback", func() {
+				t.offerCallback([]byte(strings.TrimSpace(msg)))
+			})
+			if err != nil {
+				t.sendErr(err)
+				return
+			}
+			t.updateStats(func(stats *Stats) {
+				stats.MessagesSent++
+			})
+			t.logMessage("SEND", msg)
+			continue
+		}
 
-		log.Trace("Request send of message to peer")
-		t.msgOutCh <- msg
+		if t.sendQueue != nil {
+			log.Trace("Queueing message for peer")
+			select {
+			case t.sendQueue <- msg:
+			default:
+				t.sendErr(ErrSendQueueFull)
+				return
+			}
+		} else if t.send != nil {
+			err = t.sendToPeer(msg)
+			if err != nil {
+				t.sendErr(err)
+				return
+			}
+		} else {
+			log.Trace("Request send of message to peer")
+			select {
+			case t.msgOutCh <- msg:
+			case <-t.stopCh:
+				log.Trace("Traversal stopped, discarding remaining output")
+				return
+			}
+		}
+		t.updateStats(func(stats *Stats) {
+			stats.MessagesSent++
+		})
+		t.logEvent(slog.LevelDebug, "Sent message to peer", "msg", strings.TrimSpace(msg))
+		t.logMessage("SEND", msg)
 
-		if IsFiveTuple(msg) {
+		err = t.recordCandidates(msg)
+		if err != nil {
+			t.sendErr(err)
+			return
+		}
+
+		if t.endOfCandidates != nil && IsEndOfCandidates(msg) {
+			log.Trace("natty finished gathering candidates")
+			err = callSafely("end-of-candidates callback", t.endOfCandidates)
+			if err != nil {
+				t.sendErr(err)
+				return
+			}
+		}
+
+		if t.isFiveTuple(msg) {
 			log.Trace("We got a FiveTuple!")
-			fiveTuple := &FiveTuple{}
-			err = json.Unmarshal([]byte(msg), fiveTuple)
+			fiveTuple, err := t.decodeFiveTuple([]byte(msg))
 			if err != nil {
-				t.errCh <- err
+				t.sendErr(fmt.Errorf("%w: %s: %v", ErrMalformedFiveTuple, strings.TrimSpace(msg), err))
+				return
+			}
+			if !fiveTuple.Proto.Valid() {
+				t.sendErr(fmt.Errorf("%w: unknown protocol %q", ErrMalformedFiveTuple, fiveTuple.Proto))
+				return
+			}
+			if t.expectedRemote != "" {
+				err = checkRemote(fiveTuple.Remote, t.expectedRemote)
+				if err != nil {
+					t.sendErr(err)
+					return
+				}
+			}
+			var reported foundations
+			t.candidatesMutex.Lock()
+			if json.Unmarshal([]byte(msg), &reported) == nil {
+				t.foundations = reported
+			}
+			t.fiveTupleSeen = true
+			t.candidatesMutex.Unlock()
+			select {
+			case t.fiveTupleCh <- fiveTuple:
+			case <-t.stopCh:
 				return
 			}
-			t.fiveTupleCh <- fiveTuple
 		} else if IsError(msg) {
 			log.Trace("We got an error")
 			msgmap := make(map[string]string)
-			err = json.Unmarshal([]byte(msg), msgmap)
-			if err == nil {
-				err = fmt.Errorf("Error reported by natty: %s", msgmap["message"])
+			err = json.Unmarshal([]byte(msg), &msgmap)
+			if err != nil {
+				err = fmt.Errorf("Unable to parse error reported by natty: %s", err)
+			} else if detail, ok := symmetricNATDetail(msgmap["message"], t.stderrTail.String()); ok {
+				err = fmt.Errorf("%w: %s", ErrSymmetricNAT, detail)
 			}
-			t.errCh <- err
+			t.sendErr(&TraversalError{
+				Message:  msgmap["message"],
+				Stderr:   t.stderrTail.String(),
+				ExitCode: -1,
+				Err:      err,
+			})
 			return
 		}
 	}
 }
 
+// readMessage reads the next message from natty's stdout. Messages are
+// normally single lines, but a JSON object may also be spread across several
+// lines, for example if it's pretty-printed, in which case lines are
+// accumulated until the object is complete. JSON messages are returned in
+// compact form so that they can be recognized by IsFiveTuple and friends.
+func readMessage(r *bufio.Reader) (string, error) {
+	msg, err := r.ReadString('\n')
+	if err != nil {
+		return msg, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(msg), "{") {
+		return msg, nil
+	}
+	for !json.Valid([]byte(msg)) && len(msg) < maxMessageSize {
+		log.Trace("Incomplete JSON message, reading more")
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return msg + line, err
+		}
+		msg += line
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, []byte(msg)) != nil {
+		// Not valid JSON after all, pass it on as is
+		return msg, nil
+	}
+	return compacted.String() + "\n", nil
+}
+
 // processStderr copies the output from natty's stderr to the configured
-// traceOut
+// traceOut (line by line if it's being timestamped), keeping the most recent output in stderrTail.
 func (t *Traversal) processStderr() {
 	defer t.iowg.Done()
 
-	_, err := io.Copy(t.traceOut, t.stderr)
-	t.errCh <- err
+	traceOut := t.traceOut
+	if t.timestampedDebug {
+		lw := &lineWriter{onLine: func(line string) {
+			fmt.Fprintf(t.traceOut, "%s %s\n", time.Now().Format(time.RFC3339Nano), line)
+		}}
+		defer lw.Flush()
+		traceOut = lw
+	}
+	out := io.MultiWriter(traceOut, t.stderrTail)
+	if t.debugBuffer != nil {
+		out = io.MultiWriter(out, t.debugBuffer)
+	}
+	if t.logger != nil {
+		lw := &lineWriter{onLine: t.logStderrLine}
+		defer lw.Flush()
+		out = io.MultiWriter(out, lw)
+	}
+	_, err := io.Copy(out, t.stderr)
+	t.sendErr(err)
 }
 
 func (t *Traversal) processIncoming() {
+	defer t.incomingwg.Done()
+
 	for {
-		msg := <-t.msgInCh
+		var msg string
+		select {
+		case msg = <-t.msgInCh:
+		case <-t.stopCh:
+			log.Trace("Traversal stopped, no longer processing incoming messages")
+			return
+		}
 		log.Tracef("Got incoming message: %s", msg)
+		if IsSessionDescription(msg) {
+			t.gotSessionDescription(false)
+		}
+		if remoteCandidates := findCandidates(msg); len(remoteCandidates) > 0 {
+			t.candidatesMutex.Lock()
+			t.remoteCandidates = append(t.remoteCandidates, remoteCandidates...)
+			t.candidatesMutex.Unlock()
+		}
+		t.logEvent(slog.LevelDebug, "Received message from peer", "msg", msg)
+		t.updateStats(func(stats *Stats) {
+			stats.MessagesReceived++
+		})
+		t.logMessage("RECV", msg)
+
+		if t.abortDetector != nil {
+			var aborted bool
+			err := callSafely("abort detector", func() { aborted = t.abortDetector([]byte(msg)) })
+			if err != nil {
+				t.sendErr(err)
+				return
+			}
+			if aborted {
+				log.Tracef("Peer aborted traversal: %s", msg)
+				t.sendErr(ErrPeerAborted)
+				return
+			}
+		}
 
-		if IsFiveTuple(msg) {
+		if t.isFiveTuple(msg) {
 			log.Trace("Incoming message was a FiveTuple!")
-			t.peerGotFiveTupleCh <- true
+			select {
+			case t.peerGotFiveTupleCh <- true:
+			case <-t.stopCh:
+			}
 			continue
 		}
 
 		log.Trace("Forward message to natty process")
-		_, err := t.stdin.Write([]byte(msg))
-		if err == nil {
-			_, err = t.stdin.Write([]byte("\n"))
+		err := t.writeMessage(msg)
+		if isClosedPipe(err) {
+			log.Tracef("natty's stdin is closed, no longer forwarding messages: %s", err)
+			t.sendErr(ErrClosed)
+			return
 		}
 		if err != nil {
 			log.Tracef("Unable to forward message to natty process: %s: %s", msg, err)
-			t.errCh <- err
+			t.sendErr(err)
 		} else {
 			log.Tracef("Forwarded message to natty process: %s", msg)
 		}
 	}
 }
 
+// isClosedPipe indicates whether err is the result of writing to a pipe that's
+// been closed, by us or because natty exited.
+func isClosedPipe(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EPIPE)
+}
+
+// rawStdoutLine passes a raw line of natty's stdout to our raw stdout
+// callback. Since this happens while reading stdout, a panicking callback is
+// logged rather than failing the traversal.
+func (t *Traversal) rawStdoutLine(line string) {
+	err := callSafely("raw stdout callback", func() {
+		t.rawStdoutCallback(line)
+	})
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
+// sendToPeer passes msg to our send callback, returning a *SendError if that
+// fails.
+func (t *Traversal) sendToPeer(msg string) error {
+	log.Trace("Sending message to peer")
+	var sendErr error
+	err := callSafely("send callback", func() {
+		sendErr = t.send([]byte(strings.TrimSpace(msg)))
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		return &SendError{Msg: strings.TrimSpace(msg), Err: err}
+	}
+	return nil
+}
+
+// processSendQueue passes the messages queued by processStdout to our send
+// callback, so that a slow send doesn't stop natty's output from being read.
+// The attempt doesn't wait for this to finish, since send may be stuck on a
+// broken signaling channel, so it's given the attempt's channels rather than
+// looking them up on t.
+func (t *Traversal) processSendQueue(queue chan string, stopCh chan struct{}, errCh chan error) {
+	for {
+		select {
+		case <-stopCh:
+			log.Trace("Traversal stopped, no longer sending queued messages")
+			return
+		default:
+		}
+
+		select {
+		case msg := <-queue:
+			err := t.sendToPeer(msg)
+			if err != nil {
+				t.reportError(err)
+				select {
+				case errCh <- err:
+				case <-stopCh:
+				}
+				return
+			}
+		case <-stopCh:
+			log.Trace("Traversal stopped, no longer sending queued messages")
+			return
+		}
+	}
+}
+
+// callSafely calls fn, which invokes a user-supplied callback, converting any
+// panic into an error so that a buggy callback fails the traversal instead of
+// leaving natty running with nobody reading its output.
+func callSafely(name string, fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unexpected panic in %s: %v", name, r)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// sendErr reports err on Errors() and on errCh for the current attempt. If the
+// attempt has already stopped, nobody is listening on errCh anymore and the
+// error only goes to Errors(), so that background goroutines never block on a
+// full errCh.
+func (t *Traversal) sendErr(err error) {
+	t.reportError(err)
+	select {
+	case t.errCh <- err:
+	case <-t.stopCh:
+		log.Tracef("Traversal stopped, dropping error: %v", err)
+	}
+}
+
+// reportError passes err on to Errors(), unless it's nil or just signals the
+// end of natty's output.
+func (t *Traversal) reportError(err error) {
+	if err == nil || err == io.EOF {
+		return
+	}
+	select {
+	case t.errorsCh <- err:
+	default:
+		log.Tracef("Too many unread errors, dropping: %v", err)
+	}
+}
+
 func (t *Traversal) waitForFiveTuple() (*FiveTuple, error) {
 	timeout := t.timeout
 	if timeout == 0 {
 		timeout = reallyHighTimeout
 	}
 
+	idleTimeout := t.idleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = reallyHighTimeout
+	}
+
+	start := time.Now()
 	timeoutCh := time.After(timeout)
+	idleTimer := time.NewTimer(idleTimeout)
+	defer idleTimer.Stop()
 
 	for {
 		select {
 		case result := <-t.fiveTupleCh:
-			// Wait for peer to get FiveTuple before returning.  If we didn't do
-			// this, our natty instance might stop running before the peer
-			// finishes its work to get its own FiveTuple.
-			log.Trace("Got our own FiveTuple, waiting for peer to get FiveTuple")
-			<-t.peerGotFiveTupleCh
-			log.Trace("Peer got FiveTuple!")
-			return result, nil
+			return t.waitForPeer(result, timeoutCh, start)
 		case err := <-t.errCh:
 			if err != nil && err != io.EOF {
 				return nil, err
 			}
+		case <-t.activityCh:
+			idleTimer.Reset(idleTimeout)
 		case <-timeoutCh:
-			msg := "Timed out waiting for five-tuple"
-			log.Trace(msg)
-			return nil, fmt.Errorf(msg)
+			log.Trace("Timed out waiting for five-tuple")
+			return nil, &TimeoutError{Elapsed: time.Since(start)}
+		case <-t.watchdogCh:
+			log.Tracef("natty exceeded its maximum lifetime of %v, stopping it", t.maxProcessLifetime)
+			return nil, &TimeoutError{Elapsed: time.Since(start), Watchdog: true}
+		case <-idleTimer.C:
+			log.Tracef("natty produced no output for %v, treating it as stalled", idleTimeout)
+			return nil, &TimeoutError{Elapsed: time.Since(start), Idle: true}
+		case <-t.ctx.Done():
+			log.Tracef("Context done: %s", t.ctx.Err())
+			return nil, t.ctxErr()
+		case <-t.closedCh:
+			log.Trace("Traversal closed while waiting for five-tuple")
+			return nil, ErrClosed
+		case <-t.exitedCh:
+			return t.handleExit(timeoutCh, start)
 		}
 	}
 }
 
+// waitForPeer waits for the peer to get its FiveTuple before returning our
+// own. If we didn't do this, our natty instance might stop running before the
+// peer finishes its work to get its own FiveTuple. The peer only has until
+// timeoutCh fires, so that a peer that never reports back can't keep natty
+// running past the configured timeout.
+func (t *Traversal) waitForPeer(result *FiveTuple, timeoutCh <-chan time.Time, start time.Time) (*FiveTuple, error) {
+	log.Trace("Got our own FiveTuple, waiting for peer to get FiveTuple")
+	select {
+	case <-t.peerGotFiveTupleCh:
+		log.Trace("Peer got FiveTuple!")
+		return result, nil
+	case <-timeoutCh:
+		log.Trace("Timed out waiting for peer to get FiveTuple")
+		return nil, &TimeoutError{Elapsed: time.Since(start)}
+	case <-t.watchdogCh:
+		log.Tracef("natty exceeded its maximum lifetime of %v while waiting for peer, stopping it", t.maxProcessLifetime)
+		return nil, &TimeoutError{Elapsed: time.Since(start), Watchdog: true}
+	case <-t.ctx.Done():
+		log.Tracef("Context done while waiting for peer: %s", t.ctx.Err())
+		return nil, t.ctxErr()
+	case <-t.closedCh:
+		log.Trace("Traversal closed while waiting for peer")
+		return nil, ErrClosed
+	}
+}
+
+// ctxErr returns the error for our Context being done, which is a
+// *TimeoutError if its deadline has passed.
+func (t *Traversal) ctxErr() error {
+	err := t.ctx.Err()
+	if err == context.DeadlineExceeded {
+		return &TimeoutError{Elapsed: t.Stats().Duration}
+	}
+	return err
+}
+
+// handleExit determines the result of a traversal whose natty process exited
+// on its own. Since stdout and stderr have been fully processed by the time the
+// process is reaped, anything natty reported is already sitting in our
+// channels.
+func (t *Traversal) handleExit(timeoutCh <-chan time.Time, start time.Time) (*FiveTuple, error) {
+	select {
+	case <-t.closedCh:
+		log.Trace("Traversal closed")
+		return nil, ErrClosed
+	default:
+	}
+
+	select {
+	case result := <-t.fiveTupleCh:
+		return t.waitForPeer(result, timeoutCh, start)
+	default:
+	}
+
+	for {
+		select {
+		case err := <-t.errCh:
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+		default:
+			log.Tracef("natty exited without a five-tuple: %v", t.exitErr)
+			if t.exitErr != nil {
+				err := t.exitErr
+				if detail, ok := symmetricNATDetail(t.stderrTail.String()); ok {
+					err = fmt.Errorf("%w: %s: %v", ErrSymmetricNAT, detail, t.exitErr)
+				}
+				return nil, &TraversalError{
+					Stderr:   t.stderrTail.String(),
+					ExitCode: t.cmd.ExitCode(),
+					Err:      err,
+				}
+			}
+			return nil, ErrNoResult
+		}
+	}
+}
+
+// symmetricNATDetail looks through texts (natty's error messages and stderr
+// output) for a line reporting a symmetric NAT, returning that line.
+func symmetricNATDetail(texts ...string) (string, bool) {
+	for _, text := range texts {
+		for _, line := range strings.Split(text, "\n") {
+			if strings.Contains(strings.ToLower(line), "symmetric nat") {
+				return strings.TrimSpace(line), true
+			}
+		}
+	}
+	return "", false
+}
+
 func IsFiveTuple(msg string) bool {
-	return strings.Contains(msg, "\"type\":\"5-tuple\"")
+	return strings.Contains(msg, "\"type\":\""+defaultResultMarker+"\"")
+}
+
+// isFiveTuple is like IsFiveTuple, but looks for the type configured with
+// WithResultMarker. Failing that, it recognizes any JSON message with a valid
+// proto and non-empty local and remote addresses as a FiveTuple, so that a
+// change to the type that natty uses doesn't silently break detection.
+func (t *Traversal) isFiveTuple(msg string) bool {
+	marker := t.resultMarker
+	if marker == "" {
+		marker = defaultResultMarker
+	}
+	if strings.Contains(msg, "\"type\":\""+marker+"\"") {
+		return true
+	}
+	if !strings.HasPrefix(strings.TrimSpace(msg), "{") {
+		return false
+	}
+	ft, err := t.decodeFiveTuple([]byte(msg))
+	if err != nil {
+		return false
+	}
+	if ft.Proto.Valid() && ft.Local != "" && ft.Remote != "" {
+		log.Tracef("Recognized FiveTuple by its structure: %s", strings.TrimSpace(msg))
+		return true
+	}
+	return false
+}
+
+// decodeFiveTuple decodes a 5-tuple message using the decoder configured with
+// WithFiveTupleDecoder, or json.Unmarshal by default. A panic in the decoder
+// makes decoding fail, and is recorded in LastError() so that it doesn't go
+// unnoticed when it merely stops a message from being recognized.
+func (t *Traversal) decodeFiveTuple(msg []byte) (*FiveTuple, error) {
+	if t.fiveTupleDecoder != nil {
+		var ft *FiveTuple
+		var err error
+		cbErr := callSafely("five-tuple decoder", func() {
+			ft, err = t.fiveTupleDecoder(msg)
+		})
+		if cbErr != nil {
+			if t.stderrTail != nil {
+				fmt.Fprintln(t.stderrTail, cbErr)
+			}
+			return nil, cbErr
+		}
+		if err == nil && ft == nil {
+			err = errors.New("Decoder returned no FiveTuple")
+		}
+		return ft, err
+	}
+	ft := &FiveTuple{}
+	err := json.Unmarshal(msg, ft)
+	return ft, err
 }
 
 func IsError(msg string) bool {
 	return strings.Contains(msg, "\"type\":\"error\"")
 }
+
+// IsSessionDescription indicates whether msg carries an SDP offer or answer, as
+// opposed to an ICE candidate or some other message.
+func IsSessionDescription(msg string) bool {
+	return strings.Contains(msg, "\"type\":\"offer\"") || strings.Contains(msg, "\"type\":\"answer\"")
+}
+
+// EndOfCandidates is the message with which natty signals that it has finished
+// gathering ICE candidates, as trickle ICE requires. Like other messages from
+// natty, it's passed on to the peer, where MsgIn forwards it to the peer's
+// natty. Signaling layers that carry candidates on a channel of their own can
+// also pass it to MsgIn themselves once the peer has sent its last candidate.
+const EndOfCandidates = `{"type":"end-of-candidates"}`
+
+// IsEndOfCandidates indicates whether msg is EndOfCandidates.
+func IsEndOfCandidates(msg string) bool {
+	return strings.Contains(msg, "\"type\":\"end-of-candidates\"")
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written to it,
+// or everything if max is 0. It is safe for concurrent use.
+type tailBuffer struct {
+	max   int
+	buf   []byte
+	mutex sync.Mutex
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.buf = append(b.buf, p...)
+	if b.max > 0 && len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.buf)
+}
+
+// lockedWriter is an io.Writer that serializes writes to the wrapped writer.
+type lockedWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.w.Write(p)
+}
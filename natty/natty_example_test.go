@@ -1,11 +1,11 @@
-package natty
+package natty_test
 
 import (
 	elog "log"
 	"net"
 	"time"
 
-	natty "."
+	"github.com/getlantern/go-natty/natty"
 )
 
 func ExampleOffer() {
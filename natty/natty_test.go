@@ -1,14 +1,28 @@
 package natty
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/getlantern/byteexec"
 	"github.com/getlantern/golog"
-	"github.com/getlantern/testify/assert"
 	"github.com/getlantern/waddell"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 )
 
 const (
@@ -26,6 +40,1137 @@ func TestTimeout(t *testing.T) {
 	if err != nil {
 		assert.Contains(t, err.Error(), "Timed out", "Error should mention timing out")
 	}
+	var terr *TimeoutError
+	assert.True(t, errors.As(err, &terr), "Timing out should give TimeoutError, not %v", err)
+	var traversalErr *TraversalError
+	assert.False(t, errors.As(err, &traversalErr), "Timing out is not a TraversalError")
+}
+
+func TestTimeoutKillsNatty(t *testing.T) {
+	// natty gets its FiveTuple, but the peer never reports back
+	script := `echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithTimeout(200*time.Millisecond))
+	defer offer.Close()
+	<-offer.Messages()
+	pid := offer.PID()
+	assert.True(t, pid > 0, "natty should be running")
+
+	_, err := offer.FiveTuple()
+	var terr *TimeoutError
+	assert.True(t, errors.As(err, &terr), "Timing out should give TimeoutError, not %v", err)
+	assert.Equal(t, -1, offer.PID(), "natty should have exited")
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		assert.Error(t, process.Signal(syscall.Signal(0)), "natty process should no longer exist")
+	}
+}
+
+func TestMaxProcessLifetime(t *testing.T) {
+	scripts := map[string]string{
+		"gathering": `exec sleep 30`,
+		"waiting for peer": `echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`,
+	}
+	for name, script := range scripts {
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithTimeout(30*time.Second), WithMaxProcessLifetime(200*time.Millisecond), WithRetry(2, 0))
+		start := time.Now()
+		_, err := offer.FiveTuple()
+		offer.Close()
+		var terr *TimeoutError
+		if assert.True(t, errors.As(err, &terr), "%s: Exceeding lifetime should give TimeoutError, not %v", name, err) {
+			assert.True(t, terr.Watchdog, name)
+			assert.False(t, terr.Idle, name)
+		}
+		assert.Equal(t, 2, offer.Stats().Attempts, "%s: Lifetime should apply to each attempt", name)
+		assert.True(t, time.Since(start) < 5*time.Second, "%s: Watchdog should fire well before timeout", name)
+		assert.Equal(t, -1, offer.PID(), "%s: natty should have exited", name)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	script := `for i in 1 2 3 4 5; do echo "message $i"; sleep 0.05; done
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithIdleTimeout(200*time.Millisecond))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	var terr *TimeoutError
+	if assert.True(t, errors.As(err, &terr), "Stalled natty should give TimeoutError, not %v", err) {
+		assert.True(t, terr.Idle, "TimeoutError should be marked idle")
+		assert.True(t, terr.Elapsed >= 400*time.Millisecond, "Steady output should have kept traversal alive, only got %v", terr.Elapsed)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	offer := OfferContext(ctx)
+	defer offer.Close()
+	cancel()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, context.Canceled, err, "Cancelling context should cancel traversal")
+}
+
+func TestContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Millisecond)
+	defer cancel()
+	answer := AnswerContext(ctx)
+	defer answer.Close()
+	_, err := answer.FiveTuple()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Passing deadline should end traversal, not %v", err)
+	var terr *TimeoutError
+	if assert.True(t, errors.As(err, &terr), "Passing deadline should give TimeoutError") {
+		assert.True(t, terr.Elapsed > 0, "TimeoutError should include elapsed time")
+	}
+}
+
+func TestClose(t *testing.T) {
+	assert.NoError(t, (&Traversal{}).Close(), "Closing unstarted Traversal should be a no-op")
+
+	offer := Offer(0)
+	errCh := make(chan error)
+	go func() {
+		_, err := offer.FiveTuple()
+		errCh <- err
+	}()
+	err := offer.Close()
+	assert.Equal(t, err, offer.Close(), "Closing again should return same result")
+	select {
+	case err := <-errCh:
+		assert.Equal(t, ErrClosed, err, "Closing should release FiveTuple()")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closing didn't release FiveTuple()")
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	// natty cleans up when asked to terminate
+	script := `trap 'echo cleaned up >&2; exit 0' TERM
+echo started
+while true; do sleep 0.01; done`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	<-offer.Messages()
+	assert.NoError(t, offer.Close())
+	assert.Contains(t, offer.LastError(), "cleaned up")
+
+	// natty ignores SIGTERM and gets killed
+	stubborn := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, "trap '' TERM; echo started; while true; do sleep 0.01; done")),
+		WithShutdownGrace(100*time.Millisecond))
+	<-stubborn.Messages()
+	start := time.Now()
+	assert.Error(t, stubborn.Close(), "Killed natty should have failed")
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "natty should have had its grace period")
+}
+
+func TestMsgInAfterClose(t *testing.T) {
+	offer := Offer(0)
+	offer.Close()
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, ErrClosed, offer.MsgIn("message"), "MsgIn after Close should fail")
+	}
+}
+
+func TestMsgInFraming(t *testing.T) {
+	script := `read first
+read second
+echo "$first|$second" >&2
+exit 0`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	assert.Equal(t, ErrInvalidMessage, offer.MsgIn("{\"type\":\n\"offer\"}"), "Embedded newline should be rejected")
+	assert.Equal(t, ErrInvalidMessage, offer.MsgIn("a\rb"), "Embedded carriage return should be rejected")
+	assert.NoError(t, offer.MsgIn("first\n"), "Trailing newline should be allowed")
+	assert.NoError(t, offer.MsgIn("second\r\n"), "Trailing CRLF should be allowed")
+	offer.FiveTuple()
+	assert.Equal(t, "first|second\n", offer.LastError(), "Each message should arrive as exactly one line")
+}
+
+func TestMsgInContext(t *testing.T) {
+	// natty never reads stdin, so once msgInCh fills up, MsgIn blocks
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exec sleep 30")))
+	defer offer.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, offer.MsgInContext(cancelled, "stale"))
+
+	// Use big messages so that natty's stdin pipe fills up quickly too
+	msg := strings.Repeat("x", 8192)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err = offer.MsgInContext(ctx, msg)
+		cancel()
+	}
+	assert.Equal(t, context.DeadlineExceeded, err, "MsgInContext should give up once queue is full")
+
+	offer.Close()
+	assert.Equal(t, ErrClosed, offer.MsgInContext(context.Background(), "candidate"))
+}
+
+func TestPrepare(t *testing.T) {
+	assert.NoError(t, Prepare(), "Embedded natty binary should be ready")
+}
+
+func TestEmbeddedExecShared(t *testing.T) {
+	var wg sync.WaitGroup
+	execs := make([]*byteexec.Exec, 10)
+	for i := range execs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			be, err := embeddedExec()
+			assert.NoError(t, err)
+			execs[i] = be
+		}(i)
+	}
+	wg.Wait()
+	for _, be := range execs {
+		assert.True(t, be == execs[0], "All callers should share the same extracted binary")
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, WarmUp())
+		}()
+	}
+	wg.Wait()
+	be, err := embeddedExec()
+	if assert.NoError(t, err) {
+		_, err = os.Stat(be.Filename)
+		assert.NoError(t, err, "WarmUp should have extracted natty")
+	}
+	assert.NoError(t, Prepare())
+}
+
+func TestCleanup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake natty binaries require a POSIX shell")
+	}
+	be, err := embeddedExec()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, Cleanup())
+	_, err = os.Stat(be.Filename)
+	assert.True(t, os.IsNotExist(err), "Cleanup should have removed natty, not %v", err)
+	assert.NoError(t, Cleanup(), "Cleaning up twice should be fine")
+
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	fake := OfferWithOptions(withCommandRunner(fakeRunner(script)))
+	defer fake.Close()
+	assert.NoError(t, Cleanup(), "Traversals that don't use the extracted binary shouldn't hold up Cleanup")
+
+	offer := OfferWithOptions(WithExtractDir(t.TempDir()), WithAssetFunc(sleepingAsset))
+	waitForPID(t, offer)
+	err = Cleanup()
+	if assert.Error(t, err, "Cleanup should fail while natty is running from the extracted binary") {
+		assert.Contains(t, err.Error(), "(1 in use)")
+	}
+	offer.Close()
+	<-offer.Done()
+	assert.NoError(t, Cleanup())
+
+	assert.NoError(t, WarmUp())
+	be, err = embeddedExec()
+	if assert.NoError(t, err) {
+		_, err = os.Stat(be.Filename)
+		assert.NoError(t, err, "WarmUp should have extracted natty again")
+	}
+}
+
+func TestCleanupDuringHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake natty binaries require a POSIX shell")
+	}
+	versionCh := make(chan error)
+	go func() {
+		_, err := New(WithExtractDir(t.TempDir()), WithAssetFunc(sleepingAsset), WithTimeout(500*time.Millisecond)).BinaryVersion()
+		versionCh <- err
+	}()
+	// Give the helper a moment to start
+	time.Sleep(100 * time.Millisecond)
+	assert.Error(t, Cleanup(), "Cleanup should fail while natty is running for a helper")
+	assert.Error(t, <-versionCh)
+	assert.NoError(t, Cleanup())
+	assert.NoError(t, WarmUp())
+}
+
+// sleepingAsset is an AssetFunc for a natty binary that just sleeps.
+func sleepingAsset(name string) ([]byte, error) {
+	return []byte("#!/bin/sh\nexec sleep 30\n"), nil
+}
+
+// waitForPID waits for tr to start natty.
+func waitForPID(t *testing.T, tr *Traversal) {
+	deadline := time.Now().Add(5 * time.Second)
+	for tr.PID() < 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for natty to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCleanupOnExit(t *testing.T) {
+	if os.Getenv("NATTY_TEST_CLEANUP_ON_EXIT") != "" {
+		// We're the child started below, wait to be told to exit
+		offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithCleanupOnExit())
+		defer offer.Close()
+		be, err := embeddedExec()
+		if err != nil {
+			t.Fatalf("Unable to extract natty: %s", err)
+		}
+		os.Stdout.WriteString(be.Filename + "\n")
+		time.Sleep(30 * time.Second)
+		return
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows can't send SIGTERM")
+	}
+
+	be, err := embeddedExec()
+	if !assert.NoError(t, err) {
+		return
+	}
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithCleanupOnExit())
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err = offer.FiveTuple()
+	assert.NoError(t, err)
+	<-offer.Done()
+	_, err = os.Stat(be.Filename)
+	assert.NoError(t, err, "Finished traversal shouldn't remove natty while the process is still running")
+
+	child := exec.Command(os.Args[0], "-test.run=^TestCleanupOnExit$")
+	child.Env = append(os.Environ(), "NATTY_TEST_CLEANUP_ON_EXIT=1", "TMPDIR="+t.TempDir())
+	stdout, err := child.StdoutPipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, child.Start()) {
+		return
+	}
+	filename, err := bufio.NewReader(stdout).ReadString('\n')
+	if !assert.NoError(t, err) {
+		child.Process.Kill()
+		child.Wait()
+		return
+	}
+	filename = strings.TrimSpace(filename)
+	_, err = os.Stat(filename)
+	assert.NoError(t, err, "Child should have extracted natty")
+	assert.NoError(t, child.Process.Signal(syscall.SIGTERM))
+	err = child.Wait()
+	var exitErr *exec.ExitError
+	if assert.True(t, errors.As(err, &exitErr), "Child should have been terminated, not %v", err) {
+		assert.Equal(t, syscall.SIGTERM, exitErr.Sys().(syscall.WaitStatus).Signal(), "SIGTERM should still terminate the process")
+	}
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "SIGTERM should have removed natty, not %v", err)
+
+	// In case the child shared our binary
+	assert.NoError(t, Cleanup())
+	assert.NoError(t, WarmUp())
+}
+
+func TestBinaryPath(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(filepath.Join(os.TempDir(), "natty-does-not-exist")))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "Missing binary should give ErrBinaryNotFound, not %v", err)
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	notExecutable := fakeNatty(t, "exit 0")
+	err = os.Chmod(notExecutable, 0644)
+	if err != nil {
+		t.Fatalf("Unable to chmod: %s", err)
+	}
+	answer := AnswerWithOptions(WithBinaryPath(notExecutable))
+	defer answer.Close()
+	_, err = answer.FiveTuple()
+	if assert.Error(t, err, "Non-executable binary should fail") {
+		assert.Contains(t, err.Error(), "not executable")
+	}
+}
+
+func TestAssetFunc(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake natty binaries require a POSIX shell")
+	}
+	var requested string
+	offer := OfferWithOptions(WithAssetFunc(func(name string) ([]byte, error) {
+		requested = name
+		return []byte("#!/bin/sh\necho 'from asset func' >&2\n"), nil
+	}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err)
+	assert.Equal(t, "natty", requested)
+	assert.Contains(t, offer.LastError(), "from asset func")
+
+	failing := OfferWithOptions(WithAssetFunc(func(name string) ([]byte, error) {
+		return nil, errors.New("no such asset")
+	}))
+	defer failing.Close()
+	_, err = failing.FiveTuple()
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "Failing asset func should give ErrBinaryNotFound, not %v", err)
+}
+
+func TestExtractDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake natty binaries require a POSIX shell")
+	}
+	dir := t.TempDir()
+	offer := OfferWithOptions(WithExtractDir(dir), WithAssetFunc(func(name string) ([]byte, error) {
+		return []byte("#!/bin/sh\necho \"running $0\" >&2\n"), nil
+	}))
+	defer offer.Close()
+	offer.FiveTuple()
+	assert.Contains(t, offer.LastError(), "running "+dir, "natty should have been extracted to and run from dir")
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1, "Only natty should be left in dir")
+
+	missing := OfferWithOptions(WithExtractDir(filepath.Join(dir, "does-not-exist")))
+	defer missing.Close()
+	_, err := missing.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unable to extract natty to")
+	}
+
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "read-only")
+		assert.NoError(t, os.Mkdir(readOnly, 0500))
+		notWritable := OfferWithOptions(WithExtractDir(readOnly))
+		defer notWritable.Close()
+		_, err = notWritable.FiveTuple()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not writable")
+		}
+	}
+}
+
+func TestExtraArgs(t *testing.T) {
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo "args: $@" >&2`)),
+		WithSTUNServers("stun.example.com:3478"),
+		WithExtraArgs("-foo", "bar"))
+	defer offer.Close()
+	offer.FiveTuple()
+	args := strings.TrimSpace(offer.LastError())
+	assert.True(t, strings.HasPrefix(args, "args: -offer "), "Role flag should come first: %s", args)
+	assert.True(t, strings.HasSuffix(args, " --stuns stun:stun.example.com:3478 -foo bar"), "Extra args should come last: %s", args)
+}
+
+func TestNoGoroutineLeaks(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// natty reports an error and exits while the peer keeps sending messages,
+	// each of which fails to be forwarded
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, `echo '{"type":"error","message":"failed"}'; exit 1`)))
+	for i := 0; i < 20; i++ {
+		offer.MsgIn("message")
+	}
+	_, err := offer.FiveTuple()
+	assert.Error(t, err)
+	offer.Close()
+
+	retried := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 1")), WithRetry(3, 1*time.Millisecond))
+	_, err = retried.FiveTuple()
+	assert.Error(t, err)
+	retried.Close()
+}
+
+func TestOfferCallback(t *testing.T) {
+	script := `echo '{"type":"offer","sdp":"v=0"}'
+echo '{"type":"candidate","candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host"}'`
+	sdps := make(chan []byte, 10)
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithOfferCallback(func(sdp []byte) {
+			sdps <- sdp
+		}))
+	defer offer.Close()
+
+	var msgs []string
+	for msg := range offer.Messages() {
+		msgs = append(msgs, msg)
+	}
+	if assert.Len(t, msgs, 1, "Only the candidate should go to Messages()") {
+		assert.Contains(t, msgs[0], `"type":"candidate"`)
+	}
+	if assert.Len(t, sdps, 1, "Offer should go to callback") {
+		assert.Equal(t, `{"type":"offer","sdp":"v=0"}`, string(<-sdps))
+	}
+	assert.Equal(t, 2, offer.Stats().MessagesSent)
+}
+
+func TestCallbackPanic(t *testing.T) {
+	script := `echo '{"type":"offer","sdp":"v=0"}'
+exec sleep 30`
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithOfferCallback(func(sdp []byte) {
+			panic("callback bug")
+		}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "callback bug")
+	}
+	offer.procMutex.Lock()
+	exitedCh := offer.exitedCh
+	offer.procMutex.Unlock()
+	select {
+	case <-exitedCh:
+	default:
+		t.Fatal("natty process should have been reaped")
+	}
+}
+
+func TestPID(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "echo $$; exec sleep 30")))
+	defer offer.Close()
+	msg := <-offer.Messages()
+	assert.Equal(t, strings.TrimSpace(msg), strconv.Itoa(offer.PID()))
+	offer.Close()
+	assert.Equal(t, -1, offer.PID(), "PID should be -1 after exit")
+}
+
+func TestEnv(t *testing.T) {
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo "$NATTY_TEST_VAR $HOME" >&2`)),
+		WithEnv(map[string]string{"NATTY_TEST_VAR": "from option", "HOME": "/overridden"}))
+	defer offer.Close()
+	offer.FiveTuple()
+	assert.Equal(t, "from option /overridden\n", offer.LastError())
+}
+
+func TestFiveTupleAsync(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 0")))
+	defer offer.Close()
+	fiveTupleCh, errCh := offer.FiveTupleAsync()
+	select {
+	case err := <-errCh:
+		assert.Equal(t, ErrNoResult, err)
+	case ft := <-fiveTupleCh:
+		t.Fatalf("Unexpected FiveTuple: %s", ft)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for result")
+	}
+	_, ok := <-fiveTupleCh
+	assert.False(t, ok, "FiveTuple channel should be closed")
+	_, ok = <-errCh
+	assert.False(t, ok, "Error channel should be closed")
+}
+
+func TestResultMarker(t *testing.T) {
+	scripts := map[string]string{
+		"marker": `echo '{"type":"result","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`,
+		"structure": `echo '{"kind":"tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`,
+	}
+	for name, script := range scripts {
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithResultMarker("result"))
+		<-offer.Messages()
+		assert.NoError(t, offer.MsgIn(`{"type":"result","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`), name)
+		ft, err := offer.WaitForResult(5 * time.Second)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String(), name)
+		}
+		offer.Close()
+	}
+
+	tr := newTraversal(nil)
+	assert.True(t, tr.isFiveTuple(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`))
+	assert.False(t, tr.isFiveTuple(`{"type":"candidate","candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host"}`))
+	assert.False(t, tr.isFiveTuple(`{"proto":"udp","local":"127.0.0.1:1"}`), "Partial FiveTuple shouldn't be recognized")
+	assert.False(t, tr.isFiveTuple("plain text"))
+}
+
+func TestClone(t *testing.T) {
+	assert.Nil(t, (&Traversal{}).Clone())
+
+	template := OfferWithOptions(WithBinaryPath(fakeNatty(t, `echo "args: $@" >&2`)), WithSTUNServers("stun.example.com:3478"))
+	defer template.Close()
+	template.FiveTuple()
+
+	var sent []string
+	clone := template.Clone(WithExtraArgs("-foo"), WithSend(func(msg []byte) error {
+		sent = append(sent, string(msg))
+		return nil
+	}))
+	defer clone.Close()
+	assert.Equal(t, RoleOfferer, clone.Role())
+	_, err := clone.FiveTuple()
+	assert.Equal(t, ErrNoResult, err)
+	assert.Contains(t, clone.LastError(), "--stuns stun:stun.example.com:3478 -foo\n", "Clone should have template's options plus its own")
+	assert.False(t, strings.Contains(template.LastError(), "-foo"), "Template should be unaffected by clone")
+}
+
+func TestCloneSharedWriters(t *testing.T) {
+	script := `for i in 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20; do
+  echo "debug line" >&2
+  echo '{"type":"candidate","candidate":"c"}'
+done`
+	var debugBuf, logBuf bytes.Buffer
+	template := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithDebugOutput(&debugBuf),
+		WithMessageLog(&logBuf),
+		WithSend(func(msg []byte) error { return nil }))
+	defer template.Close()
+	template.FiveTuple()
+
+	clones := make([]*Traversal, 8)
+	for i := range clones {
+		clones[i] = template.Clone()
+		defer clones[i].Close()
+	}
+	var wg sync.WaitGroup
+	for _, clone := range clones {
+		wg.Add(1)
+		go func(clone *Traversal) {
+			defer wg.Done()
+			clone.FiveTuple()
+		}(clone)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 9*20, strings.Count(debugBuf.String(), "debug line\n"), "Debug output of all clones should be intact")
+	lines := strings.Split(strings.TrimSuffix(logBuf.String(), "\n"), "\n")
+	if assert.Len(t, lines, 9*20, "Message log of all clones should be intact") {
+		for _, line := range lines {
+			assert.Len(t, strings.Fields(line), 3, "Unexpected message log line %q", line)
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	assert.Nil(t, (&Traversal{}).Done())
+
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "read line; exit 1")))
+	defer offer.Close()
+	select {
+	case <-offer.Done():
+		t.Fatal("Traversal shouldn't be done yet")
+	default:
+	}
+	assert.NoError(t, offer.Err(), "Unfinished traversal should have no error")
+
+	assert.NoError(t, offer.MsgIn("bye"))
+	select {
+	case <-offer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for traversal to finish")
+	}
+	var terr *TraversalError
+	assert.True(t, errors.As(offer.Err(), &terr), "Failed traversal should report its error, not %v", offer.Err())
+}
+
+func TestResults(t *testing.T) {
+	assert.Nil(t, (&Traversal{}).Results())
+
+	offer := New(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}))
+	defer offer.Close()
+	assert.NoError(t, offer.Start(RoleOfferer))
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	select {
+	case ft := <-offer.Results():
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for result")
+	}
+	_, open := <-offer.Results()
+	assert.False(t, open, "Results should be closed after delivering the FiveTuple")
+
+	failing := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 1")))
+	defer failing.Close()
+	_, open = <-failing.Results()
+	assert.False(t, open, "Failed traversal shouldn't deliver a result")
+	assert.Error(t, failing.Err())
+}
+
+func TestMultiLineFiveTuple(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"a"}'
+printf '{\n  "type": "5-tuple",\n  "proto": "udp",\n  "local": "127.0.0.1:1",\n  "remote": "127.0.0.1:2"\n}\n'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	assert.Equal(t, "{\"type\":\"candidate\",\"candidate\":\"a\"}\n", <-offer.Messages())
+	assert.Equal(t, "{\"type\":\"5-tuple\",\"proto\":\"udp\",\"local\":\"127.0.0.1:1\",\"remote\":\"127.0.0.1:2\"}\n", <-offer.Messages())
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	ft, err := offer.FiveTuple()
+	if assert.NoError(t, err) {
+		assert.Equal(t, &FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}, ft)
+	}
+}
+
+func TestRawStdoutCallback(t *testing.T) {
+	script := `echo 'plain text'
+printf '{\n  "type": "candidate",\n  "candidate": "a"\n}\n'
+printf 'unterminated'`
+	var lines []string
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithRawStdoutCallback(func(line string) {
+		lines = append(lines, line)
+	}))
+	defer offer.Close()
+	var msgs []string
+	for msg := range offer.Messages() {
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, []string{"plain text", "{", `  "type": "candidate",`, `  "candidate": "a"`, "}", "unterminated"}, lines)
+	assert.Equal(t, "{\"type\":\"candidate\",\"candidate\":\"a\"}\n", msgs[1], "Messages should be routed as usual")
+}
+
+func TestReadMessage(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("plain text\n{\"a\": 1}\n{\n\"b\":\n2}\n{not json\n"))
+	for _, expected := range []string{"plain text\n", "{\"a\":1}\n", "{\"b\":2}\n"} {
+		msg, err := readMessage(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+	msg, err := readMessage(r)
+	assert.Equal(t, io.EOF, err, "Incomplete JSON should be cut short by EOF")
+	assert.Equal(t, "{not json\n", msg)
+}
+
+func TestBufferedDebug(t *testing.T) {
+	script := `i=0; while [ $i -lt 1000 ]; do echo "debug line $i" >&2; i=$((i+1)); done`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithBufferedDebug())
+	defer offer.Close()
+	offer.FiveTuple()
+	out := offer.DebugOutput()
+	assert.True(t, strings.HasPrefix(out, "debug line 0\n"), "DebugOutput should include all output")
+	assert.True(t, strings.HasSuffix(out, "debug line 999\n"), "DebugOutput should include all output")
+	assert.True(t, len(out) > maxStderrTail)
+	assert.True(t, len(offer.LastError()) <= maxStderrTail)
+
+	assert.Empty(t, (&Traversal{}).DebugOutput())
+}
+
+func TestTimestampedDebug(t *testing.T) {
+	var out bytes.Buffer
+	before := time.Now()
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo "debug line 1" >&2; printf 'debug line 2' >&2`)),
+		WithDebugOutput(&out),
+		WithTimestampedDebug(),
+		WithBufferedDebug())
+	defer offer.Close()
+	offer.FiveTuple()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if assert.Len(t, lines, 2) {
+		for i, line := range lines {
+			parts := strings.SplitN(line, " ", 2)
+			ts, err := time.Parse(time.RFC3339Nano, parts[0])
+			if assert.NoError(t, err, "Line should start with a timestamp: %s", line) {
+				assert.False(t, ts.Before(before.Truncate(time.Second)))
+			}
+			assert.Equal(t, "debug line "+strconv.Itoa(i+1), parts[1])
+		}
+	}
+	assert.Equal(t, "debug line 1\ndebug line 2", offer.DebugOutput(), "Buffered debug shouldn't be timestamped")
+}
+
+func TestSend(t *testing.T) {
+	script := `echo one; echo two; echo three; read msg`
+	var sent []string
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithSend(func(msg []byte) error {
+			sent = append(sent, string(msg))
+			if len(sent) == 2 {
+				return errors.New("signaling down")
+			}
+			return nil
+		}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	var serr *SendError
+	if assert.True(t, errors.As(err, &serr), "Failed send should give SendError, not %v", err) {
+		assert.Equal(t, "two", serr.Msg)
+		assert.Equal(t, "signaling down", serr.Err.Error())
+	}
+	assert.Equal(t, []string{"one", "two"}, sent, "Traversal should stop after failed send")
+	_, ok := <-offer.Messages()
+	assert.False(t, ok, "Messages should not be delivered on channel when using WithSend")
+}
+
+func TestErrors(t *testing.T) {
+	assert.Nil(t, (&Traversal{}).Errors())
+
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, `echo one; echo two; exec sleep 30`)),
+		WithRetry(2, 0),
+		WithSend(func(msg []byte) error {
+			return errors.New("signaling down")
+		}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Error(t, err)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-offer.Errors():
+			var serr *SendError
+			if assert.True(t, errors.As(err, &serr), "Failed send should be reported as SendError, not %v", err) {
+				assert.Equal(t, "one", serr.Msg)
+			}
+		default:
+			t.Fatalf("Failed send of attempt %d should be reported on Errors", i+1)
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	script := `echo one; echo two; echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`
+	unblock := make(chan struct{})
+	var sent []string
+	var mx sync.Mutex
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithSendQueueSize(10),
+		WithSend(func(msg []byte) error {
+			<-unblock
+			mx.Lock()
+			sent = append(sent, string(msg))
+			mx.Unlock()
+			return nil
+		}))
+	defer offer.Close()
+
+	// natty's output is read even though nothing has been sent yet, so we see
+	// the FiveTuple
+	for offer.Stats().MessagesSent < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(unblock)
+	numSent := func() int {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(sent)
+	}
+	for numSent() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+	mx.Lock()
+	assert.Equal(t, []string{"one", "two"}, sent[:2], "Queued messages should be sent in order")
+	mx.Unlock()
+
+	stuck := make(chan struct{})
+	overflow := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, "echo one; echo two; echo three; exec sleep 30")),
+		WithSendQueueSize(1),
+		WithSend(func(msg []byte) error {
+			<-stuck
+			return nil
+		}))
+	defer overflow.Close()
+	_, err = overflow.FiveTuple()
+	assert.Equal(t, ErrSendQueueFull, err)
+	close(stuck)
+}
+
+func TestNilSend(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"a"}'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithSend(nil))
+	defer offer.Close()
+	select {
+	case msg := <-offer.Messages():
+		assert.Equal(t, "{\"type\":\"candidate\",\"candidate\":\"a\"}\n", msg, "Nil send should deliver messages on channel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestWaitForResult(t *testing.T) {
+	_, err := (&Traversal{}).WaitForResult(time.Second)
+	assert.Equal(t, ErrNotStarted, err)
+
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "read msg")))
+	defer offer.Close()
+	_, err = offer.WaitForResult(10 * time.Millisecond)
+	var terr *TimeoutError
+	assert.True(t, errors.As(err, &terr), "Waiting too long should give TimeoutError, not %v", err)
+
+	// The traversal keeps going after WaitForResult gives up
+	assert.NoError(t, offer.MsgIn("done"))
+	_, err = offer.WaitForResult(5 * time.Second)
+	assert.Equal(t, ErrNoResult, err)
+}
+
+func TestStartStop(t *testing.T) {
+	answer := New(WithEcho(FiveTuple{UDP, "127.0.0.1:2", "127.0.0.1:1"}))
+	defer answer.Close()
+	_, err := answer.WaitForResult(time.Second)
+	assert.Equal(t, ErrNotStarted, err, "New shouldn't start the Traversal")
+	assert.Equal(t, RoleUnknown, answer.Role())
+	assert.Error(t, answer.Start(RoleUnknown))
+
+	assert.NoError(t, answer.Start(RoleAnswerer))
+	assert.Equal(t, ErrAlreadyStarted, answer.Start(RoleOfferer))
+	assert.Equal(t, RoleAnswerer, answer.Role())
+	assert.Equal(t, "{\"type\":\"5-tuple\",\"proto\":\"udp\",\"local\":\"127.0.0.1:2\",\"remote\":\"127.0.0.1:1\"}\n", <-answer.Messages())
+	assert.NoError(t, answer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`))
+	<-answer.Done()
+	ft, err := answer.WaitForResult(0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:2->127.0.0.1:1", ft.String())
+	}
+	assert.NoError(t, answer.Stop())
+
+	stopped := New(WithBinaryPath(fakeNatty(t, "exec sleep 30")))
+	assert.NoError(t, stopped.Stop())
+	assert.Equal(t, ErrClosed, stopped.Start(RoleOfferer), "Stopped Traversal shouldn't start")
+}
+
+func TestNotStarted(t *testing.T) {
+	unstarted := New(WithEcho(FiveTuple{UDP, "127.0.0.1:2", "127.0.0.1:1"}))
+	defer unstarted.Close()
+	assert.Equal(t, ErrNotStarted, unstarted.MsgIn("hello"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, ErrNotStarted, unstarted.MsgInContext(ctx, "hello"))
+	_, err := unstarted.FiveTuple()
+	assert.Equal(t, ErrNotStarted, err)
+	_, errCh := unstarted.FiveTupleAsync()
+	assert.Equal(t, ErrNotStarted, <-errCh)
+	_, done := unstarted.NextMsgOut()
+	assert.True(t, done, "Unstarted Traversal has no messages")
+}
+
+func TestResultCallback(t *testing.T) {
+	type result struct {
+		ft  *FiveTuple
+		err error
+	}
+	resultCh := make(chan result, 2)
+	callback := func(ft *FiveTuple, err error) {
+		resultCh <- result{ft, err}
+	}
+
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithResultCallback(callback))
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	r := <-resultCh
+	if assert.NoError(t, r.err) {
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", r.ft.String())
+	}
+
+	closed := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exec sleep 30")), WithResultCallback(callback))
+	closed.Close()
+	r = <-resultCh
+	assert.Nil(t, r.ft)
+	assert.Equal(t, ErrClosed, r.err)
+
+	select {
+	case r = <-resultCh:
+		t.Fatalf("Callback should be called only once, got extra result %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLocalDescription(t *testing.T) {
+	_, err := (&Traversal{}).LocalDescription(context.Background())
+	assert.Equal(t, ErrNotStarted, err)
+
+	script := `sleep 0.1
+echo '{"type":"offer","sdp":"v=0"}'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	desc, err := offer.LocalDescription(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"type":"offer","sdp":"v=0"}`, string(desc))
+	}
+	assert.Equal(t, `{"type":"offer","sdp":"v=0"}`+"\n", <-offer.Messages(), "Description should still be passed to peer")
+
+	slow := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exec sleep 30")))
+	defer slow.Close()
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	_, err = slow.LocalDescription(shortCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	failing := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 1")))
+	defer failing.Close()
+	_, err = failing.LocalDescription(ctx)
+	var terr *TraversalError
+	assert.True(t, errors.As(err, &terr), "Failed traversal should report its error, not %v", err)
+}
+
+func TestConnectReady(t *testing.T) {
+	script := `echo '{"type":"offer","sdp":"v=0"}'
+read answer
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	<-offer.Messages()
+	select {
+	case <-offer.ConnectReady():
+		t.Fatal("Should not be ready to connect before receiving answer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, offer.MsgIn(`{"type":"answer","sdp":"v=0"}`))
+	select {
+	case <-offer.ConnectReady():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should be ready to connect after receiving answer")
+	}
+	assert.NoError(t, offer.MsgIn(`{"type":"answer","sdp":"v=0"}`), "Extra session descriptions shouldn't cause trouble")
+}
+
+func TestLockedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &lockedWriter{w: &buf}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write([]byte("0123456789\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, strings.Repeat("0123456789\n", 1000), buf.String())
+}
+
+func TestLockedWriterSharedByOption(t *testing.T) {
+	var debugBuf, logBuf bytes.Buffer
+	debugOpt := WithDebugOutput(&debugBuf)
+	logOpt := WithMessageLog(&logBuf)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		tr := New(debugOpt, logOpt)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tr.traceOut.Write([]byte("0123456789\n"))
+				tr.messageLog.Write([]byte("0123456789\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, strings.Repeat("0123456789\n", 800), debugBuf.String(), "Traversals sharing WithDebugOutput should share its lock")
+	assert.Equal(t, strings.Repeat("0123456789\n", 800), logBuf.String(), "Traversals sharing WithMessageLog should share its lock")
+}
+
+func TestExitWithoutResult(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 0")))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrNoResult, err, "Clean exit without five-tuple should give ErrNoResult")
+
+	answer := AnswerWithOptions(WithBinaryPath(fakeNatty(t, "echo 'symmetric NAT' >&2; exit 3")))
+	defer answer.Close()
+	_, err = answer.FiveTuple()
+	var terr *TraversalError
+	if assert.True(t, errors.As(err, &terr), "Failed exit should give TraversalError, not %v", err) {
+		assert.Contains(t, terr.Stderr, "symmetric NAT", "TraversalError should include stderr")
+	}
+	assert.Contains(t, answer.LastError(), "symmetric NAT", "LastError should return stderr")
+	if assert.NotNil(t, terr) {
+		assert.Equal(t, 3, terr.ExitCode, "TraversalError should include exit code")
+	}
+	assert.Equal(t, 3, answer.ExitCode())
+	assert.Equal(t, 0, offer.ExitCode())
+}
+
+func TestMessages(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "echo one; echo two")))
+	defer offer.Close()
+	var msgs []string
+	for msg := range offer.Messages() {
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, []string{"one\n", "two\n"}, msgs)
+	_, done := offer.NextMsgOut()
+	assert.True(t, done, "NextMsgOut should be done once messages are exhausted")
+}
+
+func TestStats(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "echo one; echo two; read msg")))
+	defer offer.Close()
+	<-offer.Messages()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn("hello"))
+	offer.FiveTuple()
+
+	stats := offer.Stats()
+	assert.Equal(t, 2, stats.MessagesSent)
+	assert.Equal(t, 1, stats.MessagesReceived)
+	assert.False(t, stats.StartTime.IsZero(), "StartTime should be set")
+	assert.False(t, stats.CompletedTime.IsZero(), "CompletedTime should be set")
+	assert.Equal(t, stats.CompletedTime.Sub(stats.StartTime), stats.Duration)
+}
+
+func TestStatsWhileRunning(t *testing.T) {
+	script := `i=0; while [ $i -lt 200 ]; do echo "message $i"; i=$((i+1)); done
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		last := 0
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			stats := offer.Stats()
+			assert.True(t, stats.MessagesSent >= last, "MessagesSent should never go backwards")
+			last = stats.MessagesSent
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		<-offer.Messages()
+		offer.MsgIn("message")
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, 200, offer.Stats().MessagesSent)
+}
+
+func TestInvalidProtocol(t *testing.T) {
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, `echo '{"type":"5-tuple","proto":"sctp","local":"127.0.0.1:5000","remote":"127.0.0.1:6000"}'; read msg`)))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.True(t, errors.Is(err, ErrMalformedFiveTuple), "Unknown protocol should give ErrMalformedFiveTuple, not %v", err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "sctp", "Error should include the offending protocol")
+	}
 }
 
 // TestDirect starts up two local Traversals that communicate with each other
@@ -33,6 +1178,42 @@ func TestTimeout(t *testing.T) {
 // sure that the connection works.
 //
 // Run test with environment variable TRACE=true to get debug output from natty.
+func TestRetry(t *testing.T) {
+	failing := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 1")), WithRetry(3, 1*time.Millisecond))
+	defer failing.Close()
+	_, err := failing.FiveTuple()
+	var terr *TraversalError
+	assert.True(t, errors.As(err, &terr), "Exhausted retries should return last error, not %v", err)
+	assert.Equal(t, 3, failing.Stats().Attempts)
+
+	missing := OfferWithOptions(WithBinaryPath(filepath.Join(t.TempDir(), "missing")), WithRetry(3, 1*time.Millisecond))
+	defer missing.Close()
+	_, err = missing.FiveTuple()
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "Missing binary should not be retried, got %v", err)
+	assert.Equal(t, 1, missing.Stats().Attempts)
+
+	// Fail twice, then emit a five-tuple and wait for the peer
+	script := `n=$(cat "$0.count" 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > "$0.count"
+if [ $n -lt 3 ]; then exit 1; fi
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`
+	flaky := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)), WithRetry(3, 1*time.Millisecond))
+	defer flaky.Close()
+	for msg := range flaky.Messages() {
+		if IsFiveTuple(msg) {
+			break
+		}
+	}
+	assert.NoError(t, flaky.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	ft, err := flaky.FiveTuple()
+	if assert.NoError(t, err, "Third attempt should succeed") {
+		assert.Equal(t, "127.0.0.1:1", ft.Local)
+	}
+	assert.Equal(t, 3, flaky.Stats().Attempts)
+}
+
 func TestDirect(t *testing.T) {
 	doTest(t, func(offer *Traversal, answer *Traversal) {
 		go func() {
@@ -77,9 +1258,10 @@ func TestWaddell(t *testing.T) {
 		waddr := listener.Addr().String()
 
 		go func() {
-			err = server.Serve(listener)
+			err := server.Serve(listener)
 			if err != nil {
-				t.Fatalf("Unable to start waddell at %s: %s", waddr, err)
+				t.Errorf("Unable to start waddell at %s: %s", waddr, err)
+				return
 			}
 		}()
 
@@ -273,3 +1455,147 @@ func errorf(t *testing.T, msg string, args ...interface{}) {
 	tlog.Errorf("error: "+msg, args...)
 	t.Errorf(msg, args...)
 }
+
+// fakeNatty writes a shell script with the given body to a temporary file and
+// returns its path, for use with WithBinaryPath.
+func fakeNatty(t *testing.T, body string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake natty binaries require a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "natty")
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("Unable to write fake natty: %s", err)
+	}
+	return path
+}
+
+func TestCancelIndividually(t *testing.T) {
+	script := `echo '{"type":"candidate","candidate":"a"}'
+exec sleep 30`
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := OfferWithOptions(WithContext(ctx), WithBinaryPath(fakeNatty(t, script)))
+	closed := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	running := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer running.Close()
+
+	_, cancelledErrCh := cancelled.FiveTupleAsync()
+	_, closedErrCh := closed.FiveTupleAsync()
+	_, runningErrCh := running.FiveTupleAsync()
+	<-running.Messages()
+
+	cancel()
+	closed.Close()
+	assert.Equal(t, context.Canceled, <-cancelledErrCh)
+	assert.Equal(t, ErrClosed, <-closedErrCh)
+	assert.Equal(t, -1, closed.PID(), "Closed traversal's natty should have exited")
+
+	select {
+	case err := <-runningErrCh:
+		t.Fatalf("Cancelling other traversals shouldn't affect this one: %v", err)
+	case <-time.After(250 * time.Millisecond):
+	}
+	assert.NotEqual(t, -1, running.PID(), "Other traversal's natty should still be running")
+}
+
+func TestSymmetricNAT(t *testing.T) {
+	scripts := map[string]string{
+		"error message": `echo '{"type":"error","message":"ICE failed: peer is behind a symmetric NAT"}'
+exec sleep 30`,
+		"stderr": `echo 'Detected Symmetric NAT, mapped ports differ per destination' >&2
+exit 1`,
+	}
+	for name, script := range scripts {
+		offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+		_, err := offer.FiveTuple()
+		offer.Close()
+		assert.True(t, errors.Is(err, ErrSymmetricNAT), "%s: expected ErrSymmetricNAT, got %v", name, err)
+		var terr *TraversalError
+		if assert.True(t, errors.As(err, &terr), name) {
+			assert.Contains(t, terr.Err.Error(), "ymmetric NAT", name)
+		}
+		assert.Equal(t, FailureSymmetricNAT, failureReason(err), name)
+	}
+
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "echo 'no route' >&2; exit 1")))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.False(t, errors.Is(err, ErrSymmetricNAT), "Other failures shouldn't be reported as symmetric NAT")
+
+	retrying := OfferWithOptions(WithBinaryPath(fakeNatty(t, scripts["stderr"])), WithRetry(3, 1*time.Millisecond))
+	defer retrying.Close()
+	_, err = retrying.FiveTuple()
+	assert.True(t, errors.Is(err, ErrSymmetricNAT), "Expected ErrSymmetricNAT, got %v", err)
+	assert.Equal(t, 1, retrying.Stats().Attempts, "Symmetric NAT shouldn't be retried")
+}
+
+func TestAbortDetector(t *testing.T) {
+	script := `while read line; do echo "got $line" >&2; done`
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithRetry(3, 0),
+		WithAbortDetector(func(msg []byte) bool {
+			return strings.Contains(string(msg), `"type":"abort"`)
+		}))
+	defer offer.Close()
+	assert.NoError(t, offer.MsgIn("hello"))
+	for !strings.Contains(offer.LastError(), "got hello") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pid := offer.PID()
+	assert.True(t, pid > 0, "natty should be running")
+
+	assert.NoError(t, offer.MsgIn(`{"type":"abort"}`))
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrPeerAborted, err)
+	assert.Equal(t, FailurePeerAborted, failureReason(err))
+	assert.Equal(t, 1, offer.Stats().Attempts, "Aborted traversal shouldn't be retried")
+	assert.False(t, strings.Contains(offer.LastError(), "abort"), "Abort shouldn't be passed to natty")
+	assert.Equal(t, -1, offer.PID(), "natty should have exited")
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		assert.Error(t, process.Signal(syscall.Signal(0)), "natty process should no longer exist")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	assert.Equal(t, ErrNotStarted, (&Traversal{}).Restart())
+
+	script := `if [ "$1" = "-help" ]; then
+  echo "  --restart (Performs an ICE restart when told to on stdin)  type: bool  default: false"
+  exit 0
+fi
+read cmd
+echo "$cmd" >&2
+echo '{"type":"candidate","candidate":"fresh"}'
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, script)))
+	defer offer.Close()
+	assert.NoError(t, offer.Restart())
+	assert.Equal(t, "{\"type\":\"candidate\",\"candidate\":\"fresh\"}\n", <-offer.Messages())
+	assert.True(t, IsFiveTuple(<-offer.Messages()))
+	// natty has emitted its FiveTuple, so it's too late to restart
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = offer.Restart(); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, ErrClosed, err, "Restart after FiveTuple should fail")
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err = offer.FiveTuple()
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"type\":\"restart\"}\n", offer.LastError(), "Restart should send restart command to natty")
+	assert.Equal(t, ErrClosed, offer.Restart(), "Restart after finishing should fail")
+
+	// The bundled natty doesn't support restarts
+	old := OfferWithOptions(WithBinaryPath(fakeNatty(t, strings.Replace(fakeUsage, "%s", "", 1)+"\nexec sleep 30")))
+	defer old.Close()
+	err = old.Restart()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support -restart")
+	}
+	assert.False(t, strings.Contains(old.LastError(), "restart"), "Nothing should have been sent to natty")
+}
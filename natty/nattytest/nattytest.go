@@ -0,0 +1,72 @@
+// Package nattytest provides a fake natty.NatTraverser for testing code that
+// uses natty without running the natty binary.
+package nattytest
+
+import (
+	"sync"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+// FakeTraversal is a natty.NatTraverser that returns scripted results.
+type FakeTraversal struct {
+	// Result is the FiveTuple returned by FiveTuple().
+	Result *natty.FiveTuple
+
+	// Err is the error returned by FiveTuple().
+	Err error
+
+	// Out holds the messages returned by NextMsgOut(), in order. Once they're
+	// exhausted, NextMsgOut() reports done.
+	Out []string
+
+	in     []string
+	closed bool
+	mutex  sync.Mutex
+}
+
+var _ natty.NatTraverser = &FakeTraversal{}
+
+// MsgIn records msg so that it can be inspected with Received(). After Close(),
+// it returns natty.ErrClosed.
+func (f *FakeTraversal) MsgIn(msg string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return natty.ErrClosed
+	}
+	f.in = append(f.in, msg)
+	return nil
+}
+
+// NextMsgOut returns the next message from Out.
+func (f *FakeTraversal) NextMsgOut() (msg string, done bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.Out) == 0 {
+		return "", true
+	}
+	msg = f.Out[0]
+	f.Out = f.Out[1:]
+	return msg, false
+}
+
+// FiveTuple returns Result and Err.
+func (f *FakeTraversal) FiveTuple() (*natty.FiveTuple, error) {
+	return f.Result, f.Err
+}
+
+// Close marks this FakeTraversal as closed.
+func (f *FakeTraversal) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Received returns all of the messages passed to MsgIn so far.
+func (f *FakeTraversal) Received() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.in...)
+}
@@ -0,0 +1,32 @@
+package nattytest
+
+import (
+	"testing"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeTraversal(t *testing.T) {
+	ft := &natty.FiveTuple{Proto: natty.UDP, Local: "127.0.0.1:5000", Remote: "127.0.0.1:6000"}
+	var traverser natty.NatTraverser = &FakeTraversal{
+		Result: ft,
+		Out:    []string{"offer"},
+	}
+
+	msg, done := traverser.NextMsgOut()
+	assert.False(t, done)
+	assert.Equal(t, "offer", msg)
+	_, done = traverser.NextMsgOut()
+	assert.True(t, done, "Should be done once Out is exhausted")
+
+	assert.NoError(t, traverser.MsgIn("answer"))
+	assert.Equal(t, []string{"answer"}, traverser.(*FakeTraversal).Received())
+
+	result, err := traverser.FiveTuple()
+	assert.NoError(t, err)
+	assert.Equal(t, ft, result)
+
+	assert.NoError(t, traverser.Close())
+	assert.Equal(t, natty.ErrClosed, traverser.MsgIn("late"))
+}
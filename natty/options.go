@@ -0,0 +1,529 @@
+package natty
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// An Option configures a Traversal. Options are passed to OfferWithOptions and
+// AnswerWithOptions.
+type Option func(t *Traversal)
+
+// WithDebugOutput tells natty to log debug output and sends everything that
+// natty writes to stderr to w. By default, natty's stderr goes to this
+// package's trace log. Writes to w are serialized, including those of all
+// Traversals configured with the same Option (like Clones), so w need not be
+// safe for concurrent use, like a plain *os.File or *bytes.Buffer.
+func WithDebugOutput(w io.Writer) Option {
+	lw := &lockedWriter{w: w}
+	return func(t *Traversal) {
+		t.traceOut = lw
+		t.debug = true
+	}
+}
+
+// WithBufferedDebug makes the Traversal keep all of natty's stderr output in
+// memory, for retrieval with DebugOutput(). This is in addition to any output
+// configured with WithDebugOutput. Note that unlike LastError(), the amount of
+// output kept is unbounded, so this is mainly useful for tests and debugging.
+func WithBufferedDebug() Option {
+	return func(t *Traversal) {
+		t.debugBuffer = &tailBuffer{}
+	}
+}
+
+// WithTimestampedDebug prefixes each line of natty's stderr that's written to
+// the debug output (see WithDebugOutput) with the time it was read, in
+// RFC3339Nano format, to make it easier to correlate with other logs. Output
+// kept by WithBufferedDebug and LastError() isn't affected.
+func WithTimestampedDebug() Option {
+	return func(t *Traversal) {
+		t.timestampedDebug = true
+	}
+}
+
+// WithMessageLog makes the Traversal record each message that it sends to or
+// receives from the peer in w, one line per message, as an audit trail that's
+// separate from natty's debug output. Each line holds the time, the direction
+// (SEND or RECV) and the length of the message in bytes, like
+// "2006-01-02T15:04:05.999999999Z07:00 SEND 123". Since messages like
+// candidates can be sensitive, their content is only included when
+// WithMessageLogContent is also given. Writes to w are serialized, including
+// those of all Traversals configured with the same Option.
+func WithMessageLog(w io.Writer) Option {
+	lw := &lockedWriter{w: w}
+	return func(t *Traversal) {
+		t.messageLog = lw
+	}
+}
+
+// WithMessageLogContent includes the content of each message, after its
+// length, in the log configured with WithMessageLog.
+func WithMessageLogContent() Option {
+	return func(t *Traversal) {
+		t.messageLogContent = true
+	}
+}
+
+// WithLogger makes the Traversal log structured events to logger. Key
+// lifecycle events like the traversal starting, succeeding or failing (along
+// with the tail of natty's stderr) are logged at info level. Messages
+// exchanged with the peer and each line that natty writes to stderr are logged
+// at debug level. This is in addition to any output configured with
+// WithDebugOutput.
+func WithLogger(logger *slog.Logger) Option {
+	return func(t *Traversal) {
+		t.logger = logger
+	}
+}
+
+// WithMaxProcessLifetime caps how long any one natty process may run at d, as
+// a safety net against stuck natty processes that applies even if no timeout
+// or Context is configured. Once natty has been running for d, it's stopped
+// and the attempt fails with a *TimeoutError whose Watchdog is set. The cap
+// applies to each natty process separately, alongside any timeout configured
+// with WithTimeout and any deadline of the Context configured with
+// WithContext, so whichever of them expires first ends the attempt. A lifetime
+// of 0 (the default) means no cap.
+func WithMaxProcessLifetime(d time.Duration) Option {
+	return func(t *Traversal) {
+		t.maxProcessLifetime = d
+	}
+}
+
+// WithMetricsHook makes the Traversal report its progress to hook.
+func WithMetricsHook(hook MetricsHook) Option {
+	return func(t *Traversal) {
+		t.metricsHook = hook
+	}
+}
+
+// WithTimeout stops the Traversal if no FiveTuple has been obtained within
+// timeout, in which case FiveTuple() returns a *TimeoutError. This includes
+// time spent waiting for the peer to confirm that it got its own FiveTuple.
+// When the timeout fires, natty is stopped and reaped just as it is by Close().
+// A timeout of 0 (the default) means that the Traversal never times out.
+func WithTimeout(timeout time.Duration) Option {
+	return func(t *Traversal) {
+		t.timeout = timeout
+	}
+}
+
+// WithIdleTimeout stops the Traversal if natty goes for longer than timeout
+// without producing any output before a FiveTuple has been obtained, in which
+// case natty is considered stalled and FiveTuple() returns a *TimeoutError
+// with Idle set. A timeout of 0 (the default) disables this check.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(t *Traversal) {
+		t.idleTimeout = timeout
+	}
+}
+
+// WithContext ties the lifetime of the Traversal to ctx. If ctx is cancelled or
+// its deadline passes before a FiveTuple is obtained, the natty process is
+// killed and FiveTuple() returns ctx.Err(), or a *TimeoutError if the
+// deadline passed.
+func WithContext(ctx context.Context) Option {
+	return func(t *Traversal) {
+		t.ctx = ctx
+	}
+}
+
+// WithBinaryPath runs the natty binary at path instead of the one embedded in
+// this package, which avoids writing the embedded binary to disk. If path
+// contains no path separators, it is looked up in the PATH. If the binary
+// doesn't exist or isn't executable, FiveTuple() returns an error.
+func WithBinaryPath(path string) Option {
+	return func(t *Traversal) {
+		t.binaryPath = path
+	}
+}
+
+// WithAssetFunc configures the Traversal to load the natty binary using
+// assetFunc instead of the Asset function generated by go-bindata, for example
+// to use a binary from a different asset set. assetFunc is called with the
+// name "natty". WithBinaryPath takes precedence over WithAssetFunc.
+func WithAssetFunc(assetFunc AssetFunc) Option {
+	return func(t *Traversal) {
+		t.assetFunc = assetFunc
+	}
+}
+
+// WithExtractDir makes the Traversal extract the natty binary (the embedded one
+// or the one loaded with WithAssetFunc) to dir instead of byteexec's default
+// location, for example because only a particular tmpfs is writable and
+// executable in a locked-down container. If dir isn't a writable directory, or
+// is mounted noexec, FiveTuple() returns an error saying so.
+func WithExtractDir(dir string) Option {
+	return func(t *Traversal) {
+		t.extractDir = dir
+	}
+}
+
+// WithMinBinaryVersion makes the Traversal check that the natty binary is at
+// least version min (for example "1.2.0") before starting traversal. If the
+// binary is older, or its version can't be determined, FiveTuple() returns an
+// error without natty ever being run. See BinaryVersion. This requires a natty
+// that supports the -version flag. The bundled binary doesn't, so with it
+// FiveTuple() always returns an error wrapping ErrVersionUnsupported.
+func WithMinBinaryVersion(min string) Option {
+	return func(t *Traversal) {
+		t.minBinaryVersion = min
+	}
+}
+
+// WithSend makes the Traversal deliver messages for the peer by calling send,
+// instead of via Messages() and NextMsgOut(). send receives each message as
+// natty emitted it, minus the trailing newline. If send returns an error, for
+// example because the signaling channel broke, the traversal fails with a
+// *SendError. send is called from the goroutine that reads natty's output, so
+// it shouldn't block for long. A nil send is the same as not using WithSend at
+// all, so messages are delivered via Messages() and NextMsgOut().
+func WithSend(send func(msg []byte) error) Option {
+	return func(t *Traversal) {
+		t.send = send
+	}
+}
+
+// WithSendQueueSize makes the Traversal queue up to size messages for the
+// callback configured with WithSend, which is then called from a separate
+// goroutine. This way, natty's output keeps being read while a slow send is in
+// flight, instead of natty stalling once its stdout fills up. If the queue
+// overflows, the traversal fails with ErrSendQueueFull rather than blocking.
+// Once the traversal has finished, queued messages are dropped, and a send
+// that's still in flight is left to return in its own time. A size of 0 (the default) calls send directly, without a queue.
+func WithSendQueueSize(size int) Option {
+	return func(t *Traversal) {
+		t.sendQueueSize = size
+	}
+}
+
+// WithReceiveRateLimit limits the messages that MsgIn passes on to natty to
+// messagesPerSecond, with bursts of up to messagesPerSecond messages, to protect
+// natty and this host from a peer flooding us with signaling messages. MsgIn
+// rejects messages beyond the limit with ErrRateLimited, leaving it up to the
+// caller to drop them or try again later. A limit of 0 (the default) means no
+// limit.
+func WithReceiveRateLimit(messagesPerSecond int) Option {
+	return func(t *Traversal) {
+		t.receiveRate = messagesPerSecond
+	}
+}
+
+// WithOfferCallback routes the messages carrying natty's SDP offer or answer to
+// callback instead of Messages() and NextMsgOut(), for signaling layers that
+// carry session descriptions and ICE candidates on separate channels. All
+// other messages are still available from Messages(). callback receives the
+// message exactly as natty emitted it (minus the trailing newline), which is
+// what the peer's MsgIn() expects. callback is called from the goroutine that
+// reads natty's output, so it shouldn't block.
+func WithOfferCallback(callback func(sdp []byte)) Option {
+	return func(t *Traversal) {
+		t.offerCallback = callback
+	}
+}
+
+// WithCandidateCallback calls callback with each ICE candidate that natty
+// gathers, which shows which network paths are available for traversal.
+// Messages that don't carry a parseable candidate are skipped. Candidates are
+// still passed to the peer as usual. callback is called from the goroutine
+// that reads natty's output, so it shouldn't block.
+func WithCandidateCallback(callback func(Candidate)) Option {
+	return func(t *Traversal) {
+		t.candidateCallback = callback
+	}
+}
+
+// WithRawStdoutCallback calls callback with every line that natty writes to
+// stdout, exactly as written (minus the trailing newline), before it's parsed
+// and routed. This is purely for observation, for example to capture a full
+// transcript when debugging a traversal that misbehaves, and doesn't affect
+// which messages are passed to the peer. callback is called from the goroutine
+// that reads natty's output, so it shouldn't block.
+func WithRawStdoutCallback(callback func(line string)) Option {
+	return func(t *Traversal) {
+		t.rawStdoutCallback = callback
+	}
+}
+
+// WithProgressCallback makes the Traversal call callback as it moves through
+// each Phase, for example to drive a progress bar. Phases are reported in
+// order and each one at most once, though some may be skipped, for example if
+// natty fails before the peer's session description arrives. callback is
+// called from the Traversal's own goroutines and shouldn't block.
+func WithProgressCallback(callback func(Phase)) Option {
+	return func(t *Traversal) {
+		t.progressCallback = callback
+	}
+}
+
+// A ResultCallback is called with the outcome of a Traversal, see
+// WithResultCallback.
+type ResultCallback func(ft *FiveTuple, err error)
+
+// WithEndOfCandidatesCallback makes the Traversal call callback whenever natty
+// signals that it has finished gathering candidates (see EndOfCandidates), for
+// trickle ICE signaling layers that need to tell the peer explicitly. The
+// message is still passed to the peer as usual, after any candidates. If natty
+// gathers again, for example after Restart(), callback is called again.
+// callback is called from the goroutine that reads natty's output, so it
+// shouldn't block.
+func WithEndOfCandidatesCallback(callback func()) Option {
+	return func(t *Traversal) {
+		t.endOfCandidates = callback
+	}
+}
+
+// WithAbortDetector makes the Traversal check each message from the peer with
+// detector before passing it to natty, for signaling protocols in which the
+// peer can abort traversal explicitly, for example to tell the winner of a race
+// between traversals to stop. Once detector returns true for a message, that
+// message isn't passed to natty, natty is stopped and the traversal fails with
+// ErrPeerAborted, without retrying (see WithRetry). detector is called from
+// the goroutine that passes messages to natty, so it shouldn't block.
+func WithAbortDetector(detector func(msg []byte) bool) Option {
+	return func(t *Traversal) {
+		t.abortDetector = detector
+	}
+}
+
+// WithResultCallback makes the Traversal call callback with its outcome once
+// it has finished, for event-driven code that would rather be notified than
+// wait on FiveTuple() or Done(). Offer and Answer return immediately as usual,
+// and callback is called exactly once per Traversal, with either the FiveTuple
+// or the error that FiveTuple() returns, including when the Traversal is
+// closed before finishing. callback is called from the Traversal's own
+// goroutine once the result is available, so it may call methods like
+// Stats() or Connection().
+func WithResultCallback(callback ResultCallback) Option {
+	return func(t *Traversal) {
+		t.resultCallback = callback
+	}
+}
+
+// WithResultMarker sets the type of the messages with which natty reports the
+// resulting FiveTuple, in case a version of natty uses something other than the
+// default "5-tuple". Regardless of the marker, any JSON message from natty or
+// the peer that has a valid proto and local and remote addresses is also
+// treated as a FiveTuple.
+func WithResultMarker(marker string) Option {
+	return func(t *Traversal) {
+		t.resultMarker = marker
+	}
+}
+
+// A FiveTupleDecoder decodes a 5-tuple message from natty, see
+// WithFiveTupleDecoder.
+type FiveTupleDecoder func(msg []byte) (*FiveTuple, error)
+
+// WithFiveTupleDecoder makes the Traversal decode 5-tuple messages with
+// decoder, for builds of natty that report the 5-tuple in a different shape,
+// for example nested under another key. By default, messages are decoded with
+// json.Unmarshal. Besides messages with the result marker (see
+// WithResultMarker), any JSON message from natty or the peer that decoder
+// decodes into a FiveTuple with a valid proto and local and remote addresses
+// is treated as a FiveTuple. decoder should return an error for messages that
+// aren't 5-tuples.
+func WithFiveTupleDecoder(decoder FiveTupleDecoder) Option {
+	return func(t *Traversal) {
+		t.fiveTupleDecoder = decoder
+	}
+}
+
+// WithSTUNServers tells natty to use the given STUN servers, each of which
+// must be a host:port, instead of its defaults. The servers are passed to natty
+// as a comma-separated list of stun: URIs in its --stuns flag, or one at a time
+// with WithSTUNFallback.
+func WithSTUNServers(servers ...string) Option {
+	return func(t *Traversal) {
+		t.stunServers = servers
+	}
+}
+
+// WithSTUNFallback makes the Traversal try the servers configured with
+// WithSTUNServers one at a time, in order, instead of passing them all to
+// natty at once. Each attempt uses the next server, so if an attempt fails
+// natty is rerun against the next one, until one succeeds or all have failed.
+// This makes at least as many attempts as there are servers, or more if more
+// were configured with WithRetry, in which case the servers are cycled
+// through again. The server that was used last is reported in
+// Stats().STUNServer.
+func WithSTUNFallback() Option {
+	return func(t *Traversal) {
+		t.stunFallback = true
+	}
+}
+
+// WithTURNServer tells natty to relay through the TURN server at url,
+// authenticating with user and pass. url is a host:port, optionally prefixed
+// with a turn: or turns: scheme. The server is passed to natty using the
+// --turn, --turnuser and --turnpass flags. The bundled natty doesn't support
+// these, in which case FiveTuple() returns an error without natty being run.
+func WithTURNServer(url string, user string, pass string) Option {
+	return func(t *Traversal) {
+		t.turnServer = &turnServer{url, user, pass}
+	}
+}
+
+// WithExpectedRemote makes the Traversal reject a FiveTuple whose Remote
+// address isn't ipOrCIDR, which is either a single IP address like
+// "203.0.113.5" or a range in CIDR notation like "203.0.113.0/24", as a
+// defense against misdirected traversals in deployments where the peer's
+// public address is known. A rejected FiveTuple fails the attempt with an
+// error wrapping ErrUnexpectedRemote. If ipOrCIDR can't be parsed, the
+// Traversal fails without running natty.
+func WithExpectedRemote(ipOrCIDR string) Option {
+	return func(t *Traversal) {
+		t.expectedRemote = ipOrCIDR
+	}
+}
+
+// WithCleanupOnExit removes the extracted natty binaries when the process is
+// told to exit with SIGINT or SIGTERM, after which the signal takes effect as
+// usual. Go has no hook for running code when main returns or os.Exit is
+// called, so services should still call Cleanup when shutting down normally.
+// Programs that handle SIGINT or SIGTERM themselves should call Cleanup as
+// part of that instead, since with this Option they'd get the signal twice.
+func WithCleanupOnExit() Option {
+	return func(t *Traversal) {
+		t.cleanupOnExit = true
+	}
+}
+
+// WithForceRelay tells natty to gather only relay candidates, using the TURN
+// server configured with WithTURNServer, for a reliable but slower fallback
+// when direct traversal keeps failing. The peer should typically force relay
+// too. This requires a version of natty that supports the -relay flag; with
+// older versions or without a TURN server, the Traversal fails without running
+// natty. Whether the result is relayed is reported by Stats().Relayed and
+// SelectedPair.
+func WithForceRelay() Option {
+	return func(t *Traversal) {
+		t.forceRelay = true
+	}
+}
+
+// WithTURNCredentialProvider makes the Traversal get the credentials for the
+// TURN server configured with WithTURNServer from provider, instead of using
+// the fixed user and pass given there. provider is called each time natty is
+// launched, including for retries (see WithRetry), so that short-lived
+// credentials, like HMAC-based ephemeral ones, can be minted on demand. If
+// provider fails, so does the traversal. Note that an ICE restart (see
+// Restart) reuses the credentials that natty was launched with.
+func WithTURNCredentialProvider(provider TURNCredentialProvider) Option {
+	return func(t *Traversal) {
+		t.turnCredentials = provider
+	}
+}
+
+// WithLocalInterface makes natty bind to the local interface with the given
+// IP address instead of whichever one the OS picks, for example on a
+// multi-homed host. This requires a natty binary that supports the -bind flag.
+// If ip doesn't parse or natty doesn't support binding, FiveTuple() returns an
+// error without any traversal being attempted.
+func WithLocalInterface(ip string) Option {
+	return func(t *Traversal) {
+		t.localInterface = ip
+	}
+}
+
+// WithEnv sets the given environment variables for the natty process on top of
+// the environment inherited from this process, overriding any inherited
+// variables with the same names.
+func WithEnv(env map[string]string) Option {
+	return func(t *Traversal) {
+		if t.env == nil {
+			t.env = make(map[string]string, len(env))
+		}
+		for key, value := range env {
+			t.env[key] = value
+		}
+	}
+}
+
+// WithExtraArgs passes the given arguments to natty verbatim, for using natty
+// features that don't have an Option of their own. The arguments always come
+// last, after the role flag (-offer for offerers) and any flags generated from
+// other Options.
+func WithExtraArgs(args ...string) Option {
+	return func(t *Traversal) {
+		t.extraArgs = append(t.extraArgs, args...)
+	}
+}
+
+// WithResourceLimits caps the memory and CPU time that the natty process may
+// consume, so that a misbehaving natty can't starve the host. The limits are
+// applied with prlimit(2) right after natty starts, before it's given any
+// input. If they can't be applied, for example because they exceed the hard
+// limits of this process, natty is killed and the attempt fails. Resource
+// limits are only supported on Linux; on other platforms this Option is a
+// no-op.
+func WithResourceLimits(limits ResourceLimits) Option {
+	return func(t *Traversal) {
+		t.resourceLimits = &limits
+	}
+}
+
+// WithFraming sets how messages are delimited on natty's stdin and stdout, for
+// use with natty binaries that speak a protocol other than the default
+// FramingNewline. Messages returned by NextMsgOut() end with a newline
+// regardless of framing.
+func WithFraming(framing Framing) Option {
+	return func(t *Traversal) {
+		t.framing = framing
+	}
+}
+
+// WithBufferedStdin buffers the messages passed to natty's stdin and flushes
+// them every flushInterval, or sooner once 4KB have built up, instead of
+// writing each message as soon as it arrives, to save syscalls during chatty
+// negotiations. This delays each message by up to flushInterval. Messages are
+// only ever flushed whole, so natty never sees part of a message.
+func WithBufferedStdin(flushInterval time.Duration) Option {
+	return func(t *Traversal) {
+		t.stdinFlushInterval = flushInterval
+	}
+}
+
+// WithKeepalive keeps the NAT mapping for the resulting FiveTuple open after a
+// successful traversal, for applications that establish a path and then go
+// quiet for longer than NATs remember idle mappings. The Traversal dials its
+// Connection() and, for UDP, sends an empty datagram on it every interval,
+// which the peer's application will receive and should ignore. For TCP, it
+// enables TCP keepalives with the given interval instead. Keepalives stop
+// when the Traversal is closed.
+func WithKeepalive(interval time.Duration) Option {
+	return func(t *Traversal) {
+		t.keepaliveInterval = interval
+	}
+}
+
+// WithShutdownGrace configures how long natty has to exit on its own after
+// being sent SIGTERM, for example when the Traversal is closed, before it is
+// killed with SIGKILL. The default is 2 seconds. A grace period of 0 kills
+// natty immediately. On Windows, natty is always killed immediately.
+func WithShutdownGrace(grace time.Duration) Option {
+	return func(t *Traversal) {
+		t.shutdownGrace = grace
+	}
+}
+
+// WithRetry makes up to attempts attempts at traversal, rerunning natty after
+// each failed attempt. Before the first retry the Traversal sleeps for backoff,
+// doubling it for each subsequent retry. If all attempts fail, FiveTuple()
+// returns the last error. Problems that can't be fixed by retrying, like a
+// missing natty binary or a symmetric NAT, cause the Traversal to fail
+// immediately.
+//
+// Any timeout configured with WithTimeout applies to each attempt, whereas a
+// Context configured with WithContext applies to the Traversal as a whole.
+// Since each attempt starts a fresh ICE session, the peer should typically
+// retry in lockstep.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(t *Traversal) {
+		t.retryAttempts = attempts
+		t.retryBackoff = backoff
+	}
+}
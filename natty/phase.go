@@ -0,0 +1,91 @@
+package natty
+
+import (
+	"time"
+)
+
+// Phase is a coarse indication of how far along a Traversal is, suitable for
+// showing progress to users. See WithProgressCallback.
+type Phase int
+
+const (
+	// PhaseGathering means that natty is running and gathering candidates.
+	PhaseGathering Phase = iota
+	// PhaseConnecting means that session descriptions have been exchanged
+	// with the peer and natty is checking connectivity.
+	PhaseConnecting
+	// PhaseSucceeded means that the Traversal obtained a FiveTuple.
+	PhaseSucceeded
+	// PhaseFailed means that the Traversal failed.
+	PhaseFailed
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseGathering:
+		return "gathering"
+	case PhaseConnecting:
+		return "connecting"
+	case PhaseSucceeded:
+		return "succeeded"
+	case PhaseFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// progress records that phase was reached and reports it to our progress
+// callback, if one was configured. Phases only ever move forward, so a phase
+// that has already been reached (for example PhaseGathering when an attempt is
+// retried) isn't recorded or reported again.
+func (t *Traversal) progress(phase Phase) {
+	t.phaseMutex.Lock()
+	if len(t.phaseStarted) > 0 && phase <= t.phase {
+		t.phaseMutex.Unlock()
+		return
+	}
+	t.phase = phase
+	if t.phaseStarted == nil {
+		t.phaseStarted = make(map[Phase]time.Time)
+	}
+	t.phaseStarted[phase] = time.Now()
+	t.phaseMutex.Unlock()
+
+	if t.progressCallback == nil {
+		return
+	}
+	err := callSafely("progress callback", func() {
+		t.progressCallback(phase)
+	})
+	if err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
+// PhaseTimings returns how long the Traversal spent in each Phase that it has
+// reached so far, which shows for example whether a slow traversal was slow to
+// gather candidates (suggesting STUN latency) or to connect (suggesting
+// trouble reaching the peer). A phase that's still in progress is timed up to
+// now. The terminal phases, PhaseSucceeded and PhaseFailed, aren't included.
+// Phase boundaries are only as precise as what natty's output reveals.
+func (t *Traversal) PhaseTimings() map[Phase]time.Duration {
+	t.phaseMutex.Lock()
+	defer t.phaseMutex.Unlock()
+	timings := make(map[Phase]time.Duration)
+	for phase, started := range t.phaseStarted {
+		if phase >= PhaseSucceeded {
+			continue
+		}
+		// A phase ends when the next one that was reached starts
+		ended := time.Now()
+		for next := phase + 1; next <= PhaseFailed; next++ {
+			if nextStarted, ok := t.phaseStarted[next]; ok {
+				ended = nextStarted
+				break
+			}
+		}
+		timings[phase] = ended.Sub(started)
+	}
+	return timings
+}
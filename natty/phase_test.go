@@ -0,0 +1,94 @@
+package natty
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type phaseRecorder struct {
+	phases []Phase
+	mx     sync.Mutex
+}
+
+func (r *phaseRecorder) record(phase Phase) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.phases = append(r.phases, phase)
+}
+
+func (r *phaseRecorder) get() []Phase {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]Phase{}, r.phases...)
+}
+
+func TestProgressCallback(t *testing.T) {
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		fmt.Fprintln(stdout, `{"type":"offer","sdp":"o"}`)
+		stdin.ReadString('\n')
+		fmt.Fprintln(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`)
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	recorder := &phaseRecorder{}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)), WithProgressCallback(recorder.record))
+	defer offer.Close()
+
+	assert.True(t, IsSessionDescription(<-offer.Messages()))
+	assert.NoError(t, offer.MsgIn(`{"type":"answer","sdp":"a"}`))
+	assert.True(t, IsFiveTuple(<-offer.Messages()))
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+	assert.Equal(t, []Phase{PhaseGathering, PhaseConnecting, PhaseSucceeded}, recorder.get())
+}
+
+func TestProgressCallbackFailure(t *testing.T) {
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		return 1
+	}
+	recorder := &phaseRecorder{}
+	answer := AnswerWithOptions(withCommandRunner(fakeRunner(script)), WithRetry(2, 0), WithProgressCallback(recorder.record))
+	defer answer.Close()
+
+	_, err := answer.FiveTuple()
+	assert.Error(t, err)
+	assert.Equal(t, []Phase{PhaseGathering, PhaseFailed}, recorder.get(), "Retrying shouldn't report PhaseGathering again")
+	assert.Equal(t, "failed", PhaseFailed.String())
+}
+
+func TestPhaseTimings(t *testing.T) {
+	assert.Empty(t, (&Traversal{}).PhaseTimings())
+
+	script := func(stdin *bufio.Reader, stdout io.Writer, stderr io.Writer) int {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintln(stdout, `{"type":"offer","sdp":"o"}`)
+		stdin.ReadString('\n')
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintln(stdout, `{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}`)
+		// Run until killed
+		stdin.ReadString('\n')
+		return -1
+	}
+	offer := OfferWithOptions(withCommandRunner(fakeRunner(script)))
+	defer offer.Close()
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"answer","sdp":"a"}`))
+	<-offer.Messages()
+	assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+
+	timings := offer.PhaseTimings()
+	assert.Len(t, timings, 2, "Only non-terminal phases should be timed")
+	assert.True(t, timings[PhaseGathering] >= 100*time.Millisecond, "Gathering took %v", timings[PhaseGathering])
+	assert.True(t, timings[PhaseConnecting] >= 200*time.Millisecond, "Connecting took %v", timings[PhaseConnecting])
+	assert.Equal(t, timings, offer.PhaseTimings(), "Timings shouldn't change once finished")
+}
@@ -0,0 +1,44 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+)
+
+// Probe checks that this host can reach a STUN server, returning the mapped
+// (public) address that the server sees, as a quick self-test before
+// attempting traversal with a real peer, for example in a readiness check.
+// Probe runs natty as an offerer with the given Options (like WithSTUNServers)
+// until it gathers a server-reflexive candidate, then stops it. No peer is
+// needed. If natty fails or ctx is done before a mapped address is discovered,
+// Probe returns an error. Any WithContext or WithCandidateCallback in opts is
+// overridden.
+func Probe(ctx context.Context, opts ...Option) (mappedAddr string, err error) {
+	foundCh := make(chan string, 1)
+	opts = append(opts, WithContext(ctx), WithCandidateCallback(func(c Candidate) {
+		if c.Type == "srflx" {
+			select {
+			case foundCh <- c.HostPort():
+			default:
+				// Already found one
+			}
+		}
+	}))
+	t := OfferWithOptions(opts...)
+	defer t.Close()
+
+	_, errCh := t.FiveTupleAsync()
+	select {
+	case addr := <-foundCh:
+		log.Tracef("Probe found mapped address %s", addr)
+		return addr, nil
+	case err := <-errCh:
+		if addr, ok := t.MappedAddress(); ok {
+			return addr, nil
+		}
+		if err == nil {
+			err = ErrNoResult
+		}
+		return "", fmt.Errorf("Unable to discover mapped address: %w", err)
+	}
+}
@@ -0,0 +1,33 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	script := `echo '{"type":"offer","sdp":"v=0"}'
+echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+echo '{"type":"candidate","candidate":"candidate:2 1 udp 1686052607 203.0.113.5 6000 typ srflx raddr 10.0.0.1 rport 5000"}'
+exec sleep 30`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr, err := Probe(ctx, WithBinaryPath(fakeNatty(t, script)))
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.5:6000", addr)
+
+	_, err = Probe(ctx, WithBinaryPath(fakeNatty(t, "echo 'STUN server unreachable' >&2; exit 1")))
+	var terr *TraversalError
+	assert.True(t, errors.As(err, &terr), "Failing natty should give TraversalError, not %v", err)
+
+	hostOnly := `echo '{"type":"candidate","candidate":"candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}'
+exec sleep 30`
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	_, err = Probe(shortCtx, WithBinaryPath(fakeNatty(t, hostOnly)))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Probe should honor context deadline, not %v", err)
+}
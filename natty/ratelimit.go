@@ -0,0 +1,32 @@
+package natty
+
+import (
+	"time"
+)
+
+// allowReceive reports whether MsgIn may accept another message under the
+// limit configured with WithReceiveRateLimit. It implements a token bucket
+// that holds up to a second's worth of messages.
+func (t *Traversal) allowReceive() bool {
+	if t.receiveRate <= 0 {
+		return true
+	}
+	t.receiveMutex.Lock()
+	defer t.receiveMutex.Unlock()
+	now := time.Now()
+	capacity := float64(t.receiveRate)
+	if t.receiveRefilled.IsZero() {
+		t.receiveTokens = capacity
+	} else {
+		t.receiveTokens += now.Sub(t.receiveRefilled).Seconds() * capacity
+		if t.receiveTokens > capacity {
+			t.receiveTokens = capacity
+		}
+	}
+	t.receiveRefilled = now
+	if t.receiveTokens < 1 {
+		return false
+	}
+	t.receiveTokens--
+	return true
+}
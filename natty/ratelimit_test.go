@@ -0,0 +1,32 @@
+package natty
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveRateLimit(t *testing.T) {
+	offer := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}), WithReceiveRateLimit(5))
+	defer offer.Close()
+	<-offer.Messages()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, offer.MsgIn("msg "+strconv.Itoa(i)), "Messages within burst should be accepted")
+	}
+	assert.Equal(t, ErrRateLimited, offer.MsgIn("rejected"))
+	time.Sleep(250 * time.Millisecond)
+	assert.NoError(t, offer.MsgIn("msg 5"), "Limit should replenish over time")
+
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, "msg "+strconv.Itoa(i)+"\n", <-offer.Messages(), "Rejected message shouldn't reach natty")
+	}
+
+	unlimited := OfferWithOptions(WithEcho(FiveTuple{UDP, "127.0.0.1:1", "127.0.0.1:2"}))
+	defer unlimited.Close()
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, unlimited.MsgIn("msg"))
+	}
+}
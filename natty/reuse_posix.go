@@ -0,0 +1,31 @@
+//go:build !windows
+
+package natty
+
+import (
+	"syscall"
+)
+
+// reuseAddrPort sets SO_REUSEADDR and, where supported, SO_REUSEPORT on the
+// socket underlying c, so that several sockets can share its local port.
+func reuseAddrPort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err == nil {
+			err = reusePort(int(fd))
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// reusePort sets SO_REUSEPORT on fd, unless the platform doesn't support it.
+func reusePort(fd int) error {
+	if soReusePort == 0 {
+		return nil
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+}
@@ -0,0 +1,18 @@
+package natty
+
+import (
+	"syscall"
+)
+
+// reuseAddrPort sets SO_REUSEADDR on the socket underlying c, which on Windows
+// lets several sockets share its local port, like SO_REUSEPORT elsewhere.
+func reuseAddrPort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package natty
+
+// soReusePort is SO_REUSEPORT, which package syscall doesn't define for Linux.
+const soReusePort = 0x200
@@ -0,0 +1,6 @@
+//go:build !windows && !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package natty
+
+// soReusePort is 0 on platforms without SO_REUSEPORT.
+const soReusePort = 0
@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package natty
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialReusePort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	conn, err := (&FiveTuple{TCP, "127.0.0.1:0", l.Addr().String()}).Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort)
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, value, "SO_REUSEPORT should be set")
+	}
+}
@@ -0,0 +1,29 @@
+package natty
+
+// Role is the role that a Traversal plays in the ICE session.
+type Role int
+
+const (
+	// RoleUnknown is the Role of a Traversal that hasn't been started.
+	RoleUnknown Role = iota
+	// RoleOfferer is the Role of Traversals started with Offer().
+	RoleOfferer
+	// RoleAnswerer is the Role of Traversals started with Answer().
+	RoleAnswerer
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleOfferer:
+		return "offerer"
+	case RoleAnswerer:
+		return "answerer"
+	default:
+		return "unknown"
+	}
+}
+
+// Role returns the Role that this Traversal plays.
+func (t *Traversal) Role() Role {
+	return t.role
+}
@@ -0,0 +1,21 @@
+package natty
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRole(t *testing.T) {
+	assert.Equal(t, RoleUnknown, (&Traversal{}).Role())
+
+	offer := OfferWithOptions(WithBinaryPath(fakeNatty(t, "exit 0")))
+	defer offer.Close()
+	assert.Equal(t, RoleOfferer, offer.Role())
+	assert.Equal(t, "offerer", offer.Role().String())
+
+	answer := AnswerWithOptions(WithBinaryPath(fakeNatty(t, "exit 0")))
+	defer answer.Close()
+	assert.Equal(t, RoleAnswerer, answer.Role())
+	assert.Equal(t, "answerer", answer.Role().String())
+}
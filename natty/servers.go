@@ -0,0 +1,94 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TURNCredentialProvider provides credentials for authenticating with a TURN
+// server. See WithTURNCredentialProvider.
+type TURNCredentialProvider func() (user string, pass string, err error)
+
+// turnServer is a TURN server configured with WithTURNServer.
+type turnServer struct {
+	url  string
+	user string
+	pass string
+}
+
+// serverParams builds the natty flags for the configured STUN and TURN
+// servers, validating them along the way. natty takes STUN servers as a
+// comma-separated list of stun: URIs.
+func (t *Traversal) serverParams() ([]string, error) {
+	var params []string
+	if len(t.stunServers) > 0 {
+		for _, server := range t.stunServers {
+			err := validateHostPort(server)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid STUN server %s: %s", server, err)
+			}
+		}
+		servers := t.stunServers
+		if t.stunFallback {
+			servers = servers[t.stunServerIndex : t.stunServerIndex+1]
+		}
+		uris := make([]string, 0, len(servers))
+		for _, server := range servers {
+			uris = append(uris, "stun:"+server)
+		}
+		params = append(params, "--stuns", strings.Join(uris, ","))
+	}
+	if t.turnCredentials != nil && t.turnServer == nil {
+		return nil, fmt.Errorf("TURN credential provider configured without a TURN server")
+	}
+	if t.turnServer != nil {
+		addr := strings.TrimPrefix(strings.TrimPrefix(t.turnServer.url, "turns:"), "turn:")
+		// Ignore any query, like ?transport=udp
+		addr = strings.SplitN(addr, "?", 2)[0]
+		err := validateHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TURN server %s: %s", t.turnServer.url, err)
+		}
+		err = t.requireFlag("turn")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use TURN server %s: %s", t.turnServer.url, err)
+		}
+		user, pass := t.turnServer.user, t.turnServer.pass
+		if t.turnCredentials != nil {
+			// The provider could panic or be slow, which is why commandParams
+			// is called without holding procMutex
+			cbErr := callSafely("TURN credential provider", func() {
+				user, pass, err = t.turnCredentials()
+			})
+			if cbErr != nil {
+				err = cbErr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to get credentials for TURN server %s: %s", t.turnServer.url, err)
+			}
+		}
+		params = append(params,
+			"--turn", t.turnServer.url,
+			"--turnuser", user,
+			"--turnpass", pass)
+	}
+	return params, nil
+}
+
+// validateHostPort makes sure that addr is a well-formed host:port.
+func validateHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package natty
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerParams(t *testing.T) {
+	withTURN := WithBinaryPath(fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage)))
+	tr := newTraversal([]Option{
+		withTURN,
+		WithSTUNServers("stun.example.com:3478", "[2001:db8::1]:3478"),
+		WithTURNServer("turn:turn.example.com:3478?transport=udp", "user", "pass"),
+	})
+	params, err := tr.serverParams()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"--stuns", "stun:stun.example.com:3478,stun:[2001:db8::1]:3478",
+			"--turn", "turn:turn.example.com:3478?transport=udp",
+			"--turnuser", "user",
+			"--turnpass", "pass",
+		}, params)
+	}
+
+	// The bundled natty has no TURN flags
+	tr = newTraversal([]Option{
+		WithBinaryPath(fakeNatty(t, fmt.Sprintf(fakeUsage, ""))),
+		WithTURNServer("turn.example.com:3478", "user", "pass"),
+	})
+	_, err = tr.serverParams()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not support -turn")
+	}
+
+	for _, bad := range []string{"stun.example.com", ":3478", "stun.example.com:0", "stun.example.com:http"} {
+		tr = newTraversal([]Option{WithSTUNServers(bad)})
+		_, err = tr.serverParams()
+		assert.Error(t, err, "%s should be rejected", bad)
+	}
+
+	tr = newTraversal([]Option{WithTURNServer("turn:turn.example.com", "user", "pass")})
+	_, err = tr.serverParams()
+	assert.Error(t, err, "TURN server without port should be rejected")
+}
+
+func TestSTUNFallback(t *testing.T) {
+	script := `case "$*" in
+*good.example.com*)
+	echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+	exec sleep 30;;
+*)
+	echo "args: $@" >&2
+	exit 1;;
+esac`
+	offer := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithSTUNServers("bad.example.com:3478", "good.example.com:3478", "unused.example.com:3478"),
+		WithSTUNFallback())
+	defer offer.Close()
+	for msg := range offer.Messages() {
+		if IsFiveTuple(msg) {
+			assert.NoError(t, offer.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`))
+		}
+	}
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err)
+	stats := offer.Stats()
+	assert.Equal(t, 2, stats.Attempts, "Should have stopped at the first server that worked")
+	assert.Equal(t, "good.example.com:3478", stats.STUNServer)
+
+	allBad := OfferWithOptions(
+		WithBinaryPath(fakeNatty(t, script)),
+		WithSTUNServers("bad.example.com:3478", "worse.example.com:3478"),
+		WithSTUNFallback())
+	defer allBad.Close()
+	_, err = allBad.FiveTuple()
+	assert.Error(t, err)
+	assert.Equal(t, 2, allBad.Stats().Attempts, "Should have tried each server once")
+	assert.Equal(t, "worse.example.com:3478", allBad.Stats().STUNServer)
+	assert.Contains(t, allBad.LastError(), "--stuns stun:worse.example.com:3478\n", "Each attempt should only get its own server")
+}
+
+func TestTURNCredentialProvider(t *testing.T) {
+	withTURN := WithBinaryPath(fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage)))
+	calls := 0
+	tr := newTraversal([]Option{
+		withTURN,
+		WithTURNServer("turn.example.com:3478", "static", "static"),
+		WithTURNCredentialProvider(func() (string, string, error) {
+			calls++
+			return fmt.Sprintf("user%d", calls), fmt.Sprintf("pass%d", calls), nil
+		}),
+	})
+	for i := 1; i <= 2; i++ {
+		params, err := tr.serverParams()
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{
+				"--turn", "turn.example.com:3478",
+				"--turnuser", fmt.Sprintf("user%d", i),
+				"--turnpass", fmt.Sprintf("pass%d", i),
+			}, params, "Fresh credentials should be used each time")
+		}
+	}
+
+	tr = newTraversal([]Option{
+		withTURN,
+		WithTURNServer("turn.example.com:3478", "static", "static"),
+		WithTURNCredentialProvider(func() (string, string, error) {
+			return "", "", errors.New("token service down")
+		}),
+	})
+	_, err := tr.serverParams()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "token service down")
+	}
+
+	tr = newTraversal([]Option{WithTURNCredentialProvider(func() (string, string, error) {
+		return "user", "pass", nil
+	})})
+	_, err = tr.serverParams()
+	assert.Error(t, err, "Credential provider without TURN server should be rejected")
+}
+
+func TestTURNCredentialProviderPanic(t *testing.T) {
+	withTURN := WithBinaryPath(fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage)))
+	offer := OfferWithOptions(withTURN,
+		WithTURNServer("turn.example.com:3478", "static", "static"),
+		WithTURNCredentialProvider(func() (string, string, error) {
+			panic("boom")
+		}))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unexpected panic in TURN credential provider: boom")
+	}
+}
+
+func TestTURNCredentialProviderSlow(t *testing.T) {
+	withTURN := WithBinaryPath(fakeNatty(t, fmt.Sprintf(fakeUsage, fakeTURNUsage)))
+	calledCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+	offer := OfferWithOptions(withTURN,
+		WithTURNServer("turn.example.com:3478", "static", "static"),
+		WithTURNCredentialProvider(func() (string, string, error) {
+			close(calledCh)
+			<-releaseCh
+			return "user", "pass", nil
+		}))
+	<-calledCh
+	start := time.Now()
+	assert.Equal(t, -1, offer.PID(), "PID() shouldn't wait for the credential provider")
+	assert.NoError(t, offer.Close())
+	assert.True(t, time.Since(start) < time.Second, "Close() shouldn't wait for the credential provider, took %v", time.Since(start))
+}
@@ -0,0 +1,74 @@
+package natty
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Session runs a Traversal over a signaling channel, taking care of pumping
+// messages in both directions. Messages are exchanged over the channel as
+// newline-delimited lines, which is how natty itself formats them.
+type Session struct {
+	role Role
+	rw   io.ReadWriter
+	opts []Option
+}
+
+// NewSession creates a Session that negotiates with the peer over rw in the
+// given Role (RoleOfferer or RoleAnswerer), configuring its Traversals with
+// opts. The peer must run a Session with the opposite Role.
+func NewSession(role Role, rw io.ReadWriter, opts ...Option) *Session {
+	return &Session{role: role, rw: rw, opts: opts}
+}
+
+// Negotiate runs a Traversal with the peer and returns the resulting
+// FiveTuple. Traversal stops when ctx is done. Note that the goroutine reading
+// from the signaling channel only stops once the read returns, so callers
+// should close the channel once they're done with it.
+func (s *Session) Negotiate(ctx context.Context) (*FiveTuple, error) {
+	opts := append([]Option{}, s.opts...)
+	opts = append(opts, WithContext(ctx), WithSend(s.send))
+
+	var t *Traversal
+	switch s.role {
+	case RoleOfferer:
+		t = OfferWithOptions(opts...)
+	case RoleAnswerer:
+		t = AnswerWithOptions(opts...)
+	default:
+		return nil, fmt.Errorf("Unable to negotiate with unknown role %s", s.role)
+	}
+	defer t.Close()
+
+	go s.receive(ctx, t)
+	return t.FiveTuple()
+}
+
+// send writes msg to the signaling channel.
+func (s *Session) send(msg []byte) error {
+	_, err := s.rw.Write(append(msg, '\n'))
+	return err
+}
+
+// receive reads messages from the signaling channel and passes them to t until
+// reading fails or t is finished.
+func (s *Session) receive(ctx context.Context, t *Traversal) {
+	r := bufio.NewReader(s.rw)
+	for {
+		msg, err := r.ReadString('\n')
+		msg = strings.TrimSpace(msg)
+		if msg != "" {
+			if inErr := t.MsgInContext(ctx, msg); inErr != nil {
+				log.Tracef("Stopped receiving messages from peer: %s", inErr)
+				return
+			}
+		}
+		if err != nil {
+			log.Tracef("Unable to read from signaling channel: %s", err)
+			return
+		}
+	}
+}
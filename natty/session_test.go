@@ -0,0 +1,46 @@
+package natty
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	offererScript := `echo '{"type":"offer","sdp":"o"}'
+read answer
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:2"}'
+exec sleep 30`
+	answererScript := `read offer
+echo '{"type":"answer","sdp":"a"}'
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}'
+exec sleep 30`
+
+	offerConn, answerConn := net.Pipe()
+	defer offerConn.Close()
+	defer answerConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	answerResult := make(chan *FiveTuple, 1)
+	go func() {
+		ft, err := NewSession(RoleAnswerer, answerConn, WithBinaryPath(fakeNatty(t, answererScript))).Negotiate(ctx)
+		assert.NoError(t, err)
+		answerResult <- ft
+	}()
+
+	ft, err := NewSession(RoleOfferer, offerConn, WithBinaryPath(fakeNatty(t, offererScript))).Negotiate(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "udp 127.0.0.1:1->127.0.0.1:2", ft.String())
+	}
+	if ft := <-answerResult; assert.NotNil(t, ft) {
+		assert.Equal(t, "udp 127.0.0.1:2->127.0.0.1:1", ft.String())
+	}
+
+	_, err = NewSession(RoleUnknown, offerConn).Negotiate(ctx)
+	assert.Error(t, err, "Negotiating without a role should fail")
+}
@@ -0,0 +1,53 @@
+package natty
+
+import (
+	"time"
+)
+
+// Stats reports on the progress of a Traversal.
+type Stats struct {
+	// StartTime is when the Traversal started.
+	StartTime time.Time
+	// CompletedTime is when the Traversal finished, or zero if it's still
+	// running.
+	CompletedTime time.Time
+	// Duration is how long the Traversal took, or how long it has been running
+	// so far if it hasn't finished yet.
+	Duration time.Duration
+	// MessagesSent is the number of messages that natty produced for the peer.
+	MessagesSent int
+	// MessagesReceived is the number of messages received from the peer.
+	MessagesReceived int
+	// Attempts is the number of times that natty has been run, which is more
+	// than 1 if failed attempts were retried (see WithRetry).
+	Attempts int
+	// STUNServer is the STUN server used by the latest attempt, when falling
+	// back through STUN servers with WithSTUNFallback. If the Traversal
+	// succeeded, this is the server that worked.
+	STUNServer string
+	// Relayed is whether the FiveTuple obtained goes through a TURN relay,
+	// either because relaying was forced with WithForceRelay or because
+	// natty selected a relay candidate on either side.
+	Relayed bool
+}
+
+// Stats returns a snapshot of the Stats for this Traversal. It's safe to call
+// Stats at any time, including concurrently with a running traversal.
+func (t *Traversal) Stats() Stats {
+	t.statsMutex.Lock()
+	defer t.statsMutex.Unlock()
+	stats := t.stats
+	if stats.CompletedTime.IsZero() {
+		stats.Duration = time.Since(stats.StartTime)
+	} else {
+		stats.Duration = stats.CompletedTime.Sub(stats.StartTime)
+	}
+	return stats
+}
+
+// updateStats applies update to our stats while holding statsMutex.
+func (t *Traversal) updateStats(update func(stats *Stats)) {
+	t.statsMutex.Lock()
+	defer t.statsMutex.Unlock()
+	update(&t.stats)
+}
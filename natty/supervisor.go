@@ -0,0 +1,99 @@
+package natty
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultSupervisorBackoff    = 1 * time.Second
+	defaultSupervisorMaxBackoff = 1 * time.Minute
+)
+
+// Supervisor keeps traversals going for long-lived connectivity. It starts
+// Traversals using a factory and, whenever one fails, starts a new one after a
+// backoff. Each FiveTuple obtained is delivered on the channel returned by
+// Run().
+type Supervisor struct {
+	// Backoff is how long to wait before restarting after the first failure.
+	// It doubles with each consecutive failure, up to MaxBackoff.
+	Backoff time.Duration
+	// MaxBackoff caps the time between restarts.
+	MaxBackoff time.Duration
+	// RenewAfter, if positive, makes the Supervisor start a fresh traversal
+	// this long after each successful one. Otherwise, supervision ends after
+	// the first success.
+	RenewAfter time.Duration
+	// OnError, if set, is called with the error from each failed traversal.
+	OnError func(err error)
+
+	factory func(ctx context.Context) *Traversal
+}
+
+// NewSupervisor creates a Supervisor that uses factory to start Traversals.
+// factory is responsible for wiring up signaling with the peer for each
+// Traversal, and should tie the Traversal to ctx (see WithContext) so that
+// stopping supervision stops the Traversal too.
+func NewSupervisor(factory func(ctx context.Context) *Traversal) *Supervisor {
+	return &Supervisor{
+		Backoff:    defaultSupervisorBackoff,
+		MaxBackoff: defaultSupervisorMaxBackoff,
+		factory:    factory,
+	}
+}
+
+// Run starts supervising in the background until ctx is done, delivering
+// each FiveTuple obtained on the returned channel. The channel is closed once
+// supervision has stopped. Consumers must keep reading from the channel, since
+// the Supervisor waits for each FiveTuple to be received before continuing.
+func (s *Supervisor) Run(ctx context.Context) <-chan *FiveTuple {
+	out := make(chan *FiveTuple)
+	go func() {
+		defer close(out)
+		s.run(ctx, out)
+	}()
+	return out
+}
+
+func (s *Supervisor) run(ctx context.Context, out chan<- *FiveTuple) {
+	backoff := s.Backoff
+	for {
+		t := s.factory(ctx)
+		ft, err := t.FiveTuple()
+		t.Close()
+
+		var wait time.Duration
+		if err == nil {
+			log.Tracef("Supervised traversal got FiveTuple: %s", ft)
+			select {
+			case out <- ft:
+			case <-ctx.Done():
+				return
+			}
+			if s.RenewAfter <= 0 {
+				return
+			}
+			backoff = s.Backoff
+			wait = s.RenewAfter
+		} else {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Tracef("Supervised traversal failed, restarting in %v: %s", backoff, err)
+			if s.OnError != nil {
+				s.OnError(err)
+			}
+			wait = backoff
+			backoff *= 2
+			if s.MaxBackoff > 0 && backoff > s.MaxBackoff {
+				backoff = s.MaxBackoff
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
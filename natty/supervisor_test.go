@@ -0,0 +1,57 @@
+package natty
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisor(t *testing.T) {
+	// Fail on the first run, succeed after that
+	script := `n=$(cat "$0.count" 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > "$0.count"
+if [ $n -lt 2 ]; then echo 'crashed' >&2; exit 1; fi
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:1","remote":"127.0.0.1:'$n'"}'
+exec sleep 30`
+	path := fakeNatty(t, script)
+
+	var errs []error
+	var mutex sync.Mutex
+	s := NewSupervisor(func(ctx context.Context) *Traversal {
+		traversal := OfferWithOptions(WithContext(ctx), WithBinaryPath(path))
+		go func() {
+			// Pretend to be a peer that got its FiveTuple
+			for msg := range traversal.Messages() {
+				if IsFiveTuple(msg) {
+					traversal.MsgIn(`{"type":"5-tuple","proto":"udp","local":"127.0.0.1:2","remote":"127.0.0.1:1"}`)
+				}
+			}
+		}()
+		return traversal
+	})
+	s.Backoff = 1 * time.Millisecond
+	s.RenewAfter = 1 * time.Millisecond
+	s.OnError = func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := s.Run(ctx)
+	assert.Equal(t, "127.0.0.1:2", (<-results).Remote)
+	assert.Equal(t, "127.0.0.1:3", (<-results).Remote, "Supervisor should renew after success")
+	cancel()
+	for range results {
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if assert.Len(t, errs, 1, "Supervisor should have restarted after the crash") {
+		assert.Contains(t, errs[0].Error(), "exit status 1")
+	}
+}
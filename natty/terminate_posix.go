@@ -0,0 +1,13 @@
+//go:build !windows
+
+package natty
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminate asks process to exit by sending it SIGTERM.
+func terminate(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
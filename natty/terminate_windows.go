@@ -0,0 +1,11 @@
+package natty
+
+import (
+	"os"
+)
+
+// terminate kills process, since Windows has no equivalent of SIGTERM that we
+// could send to a console process like natty.
+func terminate(process *os.Process) error {
+	return process.Kill()
+}
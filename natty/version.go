@@ -0,0 +1,72 @@
+package natty
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// BinaryVersion runs the natty binary that this Traversal is configured to use
+// with the -version flag and returns the version that it reports, for example
+// "1.2.0". The run is bounded by the Traversal's timeout and Context, and its
+// result is cached per binary. If the binary is too old to report its version,
+// as is the bundled one, BinaryVersion returns an error wrapping
+// ErrVersionUnsupported.
+func (t *Traversal) BinaryVersion() (string, error) {
+	out, err := t.runHelper("-version")
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(out, "unrecognized flag") {
+		return "", fmt.Errorf("%w: %s", ErrVersionUnsupported, strings.TrimSpace(out))
+	}
+	version := versionPattern.FindString(out)
+	if version == "" {
+		return "", fmt.Errorf("Unable to parse natty version from %q", strings.TrimSpace(out))
+	}
+	return version, nil
+}
+
+// checkBinaryVersion makes sure that the natty binary satisfies
+// minBinaryVersion.
+func (t *Traversal) checkBinaryVersion() error {
+	version, err := t.BinaryVersion()
+	if err != nil {
+		return err
+	}
+	if compareVersions(version, t.minBinaryVersion) < 0 {
+		return fmt.Errorf("natty binary version %s is older than the required version %s", version, t.minBinaryVersion)
+	}
+	log.Tracef("natty binary version %s satisfies minimum version %s", version, t.minBinaryVersion)
+	return nil
+}
+
+// compareVersions compares two dotted version strings numerically, returning
+// -1 if a < b, 0 if a == b and 1 if a > b. Missing components count as 0, so
+// "1.2" equals "1.2.0".
+func compareVersions(a string, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		av := versionComponent(as, i)
+		bv := versionComponent(bs, i)
+		if av < bv {
+			return -1
+		}
+		if av > bv {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionComponent(parts []string, i int) int {
+	if i >= len(parts) {
+		return 0
+	}
+	v, _ := strconv.Atoi(parts[i])
+	return v
+}
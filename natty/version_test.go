@@ -0,0 +1,82 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("1.2.0", "1.2.0"))
+	assert.Equal(t, 0, compareVersions("1.2", "1.2.0"))
+	assert.Equal(t, -1, compareVersions("1.1.9", "1.2.0"))
+	assert.Equal(t, 1, compareVersions("1.10.0", "1.9.0"))
+	assert.Equal(t, 1, compareVersions("2", "1.99.99"))
+}
+
+func TestBinaryVersion(t *testing.T) {
+	script := `if [ "$1" = "-version" ]; then echo "natty version 1.1.3"; exit 0; fi
+echo 'should not run' >&2`
+	path := fakeNatty(t, script)
+
+	offer := OfferWithOptions(WithBinaryPath(path), WithMinBinaryVersion("1.1.0"))
+	defer offer.Close()
+	version, err := offer.BinaryVersion()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.1.3", version)
+	}
+
+	tooOld := OfferWithOptions(WithBinaryPath(path), WithMinBinaryVersion("1.2.0"))
+	defer tooOld.Close()
+	_, err = tooOld.FiveTuple()
+	if assert.Error(t, err, "Old binary should be rejected") {
+		assert.Contains(t, err.Error(), "older than the required version 1.2.0")
+	}
+	assert.Empty(t, tooOld.LastError(), "natty should not have been run")
+}
+
+func TestBinaryVersionUnsupported(t *testing.T) {
+	// This is what the bundled natty says
+	path := fakeNatty(t, `echo "Error: unrecognized flag $1" >&2`)
+	offer := OfferWithOptions(WithBinaryPath(path), WithMinBinaryVersion("1.1.0"))
+	defer offer.Close()
+	_, err := offer.FiveTuple()
+	assert.True(t, errors.Is(err, ErrVersionUnsupported), "Binary without -version should give ErrVersionUnsupported, not %v", err)
+}
+
+func TestBinaryVersionHung(t *testing.T) {
+	path := fakeNatty(t, `exec sleep 30`)
+	offer := OfferWithOptions(WithBinaryPath(path), WithMinBinaryVersion("1.1.0"), WithTimeout(10*time.Second))
+	// Give the version check a moment to start
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, -1, offer.PID(), "PID() shouldn't block on the version check")
+	assert.NoError(t, offer.Close())
+	_, err := offer.FiveTuple()
+	assert.Equal(t, ErrClosed, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "Close() shouldn't wait for the version check, took %v", time.Since(start))
+
+	timedOut := OfferWithOptions(WithBinaryPath(path), WithMinBinaryVersion("1.1.0"), WithTimeout(200*time.Millisecond))
+	defer timedOut.Close()
+	_, err = timedOut.FiveTuple()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Hung version check should time out, not %v", err)
+}
+
+func TestBinaryVersionCached(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	path := fakeNatty(t, `echo run >> `+count+`
+echo "natty version 1.1.3"`)
+	for i := 0; i < 3; i++ {
+		version, err := New(WithBinaryPath(path)).BinaryVersion()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "1.1.3", version)
+		}
+	}
+	b, _ := os.ReadFile(count)
+	assert.Equal(t, "run\n", string(b), "natty should only be asked for its version once")
+}